@@ -0,0 +1,53 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "sync/atomic"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+)
+
+// health serves the liveness and readiness probes. Both bypass the limiter.
+type health struct {
+    store    storage.Storage
+    timeout  time.Duration
+    draining atomic.Bool
+}
+
+// liveness only reports that the process is serving requests.
+func (h *health) liveness(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// readiness pings the storage and fails while the server is shutting down, so the
+// instance is taken out of rotation before it stops accepting connections.
+func (h *health) readiness(w http.ResponseWriter, r *http.Request) {
+    if h.draining.Load() {
+        writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "shutting down"})
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+    defer cancel()
+    start := time.Now()
+    err := h.store.Ping(ctx)
+    check := map[string]any{"status": "ok", "latency_ms": float64(time.Since(start).Microseconds()) / 1000}
+
+    status, code := "ok", http.StatusOK
+    if err != nil {
+        check["status"] = "error"
+        check["error"] = err.Error()
+        status, code = "unavailable", http.StatusServiceUnavailable
+    }
+    writeJSON(w, code, map[string]any{"status": status, "checks": map[string]any{"storage": check}})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(code)
+    _ = json.NewEncoder(w).Encode(body)
+}
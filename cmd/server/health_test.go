@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+)
+
+// pingStore answers Ping with err; the probes call nothing else.
+type pingStore struct {
+    storage.Storage
+    err error
+}
+
+func (p pingStore) Ping(ctx context.Context) error { return p.err }
+
+func probe(t *testing.T, handler http.HandlerFunc) (int, map[string]any) {
+    t.Helper()
+    rr := httptest.NewRecorder()
+    handler(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+    var body map[string]any
+    if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+        t.Fatalf("decode body: %v", err)
+    }
+    if cc := rr.Header().Get("Cache-Control"); cc != "no-store" {
+        t.Fatalf("expected Cache-Control no-store, got %q", cc)
+    }
+    return rr.Code, body
+}
+
+func TestHealth_Liveness(t *testing.T) {
+    h := &health{store: pingStore{err: errors.New("down")}, timeout: time.Second}
+    // liveness does not depend on the storage
+    if code, body := probe(t, h.liveness); code != http.StatusOK || body["status"] != "ok" {
+        t.Fatalf("expected 200 ok, got %d %v", code, body)
+    }
+}
+
+func TestHealth_ReadinessReportsStorage(t *testing.T) {
+    h := &health{store: pingStore{}, timeout: time.Second}
+    code, body := probe(t, h.readiness)
+    if code != http.StatusOK || body["status"] != "ok" {
+        t.Fatalf("expected 200 ok, got %d %v", code, body)
+    }
+    check := body["checks"].(map[string]any)["storage"].(map[string]any)
+    if check["status"] != "ok" {
+        t.Fatalf("expected storage check ok, got %v", check)
+    }
+}
+
+func TestHealth_ReadinessFailsWhenPingFails(t *testing.T) {
+    h := &health{store: pingStore{err: errors.New("connection refused")}, timeout: time.Second}
+    code, body := probe(t, h.readiness)
+    if code != http.StatusServiceUnavailable || body["status"] != "unavailable" {
+        t.Fatalf("expected 503 unavailable, got %d %v", code, body)
+    }
+    check := body["checks"].(map[string]any)["storage"].(map[string]any)
+    if check["status"] != "error" || check["error"] != "connection refused" {
+        t.Fatalf("expected the ping error in the storage check, got %v", check)
+    }
+}
+
+func TestHealth_ReadinessFailsWhileDraining(t *testing.T) {
+    h := &health{store: pingStore{}, timeout: time.Second}
+    h.draining.Store(true)
+    if code, body := probe(t, h.readiness); code != http.StatusServiceUnavailable || body["status"] != "shutting down" {
+        t.Fatalf("expected 503 shutting down, got %d %v", code, body)
+    }
+}
+
+// slowStore only answers Ping when its context ends.
+type slowStore struct {
+    storage.Storage
+}
+
+func (slowStore) Ping(ctx context.Context) error {
+    <-ctx.Done()
+    return ctx.Err()
+}
+
+func TestHealth_ReadinessTimesOutSlowStorage(t *testing.T) {
+    h := &health{store: slowStore{}, timeout: 20 * time.Millisecond}
+    start := time.Now()
+    if code, _ := probe(t, h.readiness); code != http.StatusServiceUnavailable {
+        t.Fatalf("expected 503 for a storage slower than the timeout, got %d", code)
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("expected the probe to give up after the timeout, took %v", elapsed)
+    }
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+    "io"
+    "log/slog"
+    "strings"
+)
+
+// newLogger builds the process logger from LOG_LEVEL (debug|info|warn|error)
+// and LOG_FORMAT (json|text).
+func newLogger(w io.Writer) *slog.Logger {
+    var level slog.Level
+    switch strings.ToLower(getEnv("LOG_LEVEL", "info")) {
+    case "debug":
+        level = slog.LevelDebug
+    case "warn", "warning":
+        level = slog.LevelWarn
+    case "error":
+        level = slog.LevelError
+    default:
+        level = slog.LevelInfo
+    }
+    opts := &slog.HandlerOptions{Level: level}
+    if strings.ToLower(getEnv("LOG_FORMAT", "json")) == "text" {
+        return slog.New(slog.NewTextHandler(w, opts))
+    }
+    return slog.New(slog.NewJSONHandler(w, opts))
+}
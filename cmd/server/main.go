@@ -1,39 +1,192 @@
 package main
 
 import (
+    "context"
+    "errors"
     "fmt"
-    "log"
+    "log/slog"
+    "net"
     "net/http"
     "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+    "google.golang.org/grpc"
 
     "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
     "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
     "github.com/Douglas-Souza40/fctech-rate-limiter/pkg/middleware"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/pkg/rls"
 )
 
 func main() {
     // load env from .env if present (best-effort)
     _ = loadDotEnv()
 
-    redisAddr := getEnv("REDIS_ADDR", "localhost:6379")
-    redisPass := os.Getenv("REDIS_PASSWORD")
-    redisDB := getEnvAsInt("REDIS_DB", 0)
+    logger := newLogger(os.Stderr)
+    slog.SetDefault(logger)
 
-    store := storage.NewRedisStorage(redisAddr, redisPass, redisDB)
+    base, err := newStorage()
+    if err != nil {
+        logger.Error("invalid storage configuration", "error", err)
+        os.Exit(1)
+    }
+    var store storage.Storage = base
+    // optional local tier: hot counters and blocks answered in process, increments
+    // sent to the backend in batches
+    var hybrid *storage.HybridStorage
+    // watchUnblocks drops locally cached blocks lifted by any instance
+    var watchUnblocks func(context.Context) error
+    // newStorage refused these over shared backends that cannot announce unblocks
+    if interval := getEnvAsMillis("HYBRID_FLUSH_INTERVAL_MS", 0); interval > 0 {
+        hybrid = storage.NewHybridStorage(base, interval, int64(getEnvAsInt("HYBRID_MAX_PENDING", 0)))
+        store, watchUnblocks = hybrid, hybrid.Watch
+    } else if getEnv("BLOCK_CACHE", "false") == "true" {
+        bc := storage.NewBlockCache(base)
+        store, watchUnblocks = bc, bc.Watch
+    }
     l := limiter.NewLimiter(store)
 
     mm := middleware.NewLimiterMiddleware(l)
+    mm.TenantHeader = os.Getenv("TENANT_HEADER")
+    var costs []middleware.CostFunc
+    if rc := os.Getenv("ROUTE_COSTS"); rc != "" {
+        costs = append(costs, middleware.RouteCosts(middleware.ParseRouteCosts(rc)))
+    }
+    if h := os.Getenv("COST_HEADER"); h != "" {
+        costs = append(costs, middleware.HeaderCost(h, int64(getEnvAsInt("COST_HEADER_MAX", 100))))
+    }
+    if len(costs) > 0 {
+        mm.Cost = middleware.MultiplyCosts(costs...)
+    }
 
     mux := http.NewServeMux()
     mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
         _, _ = w.Write([]byte("pong"))
     })
 
-    handler := mm.Handler(mux)
+    // the forward-auth endpoint is checked against the original request, and the
+    // status and health endpoints must not consume budget, so none of them goes
+    // through the limiter
+    root := http.NewServeMux()
+    root.Handle(getEnv("AUTH_PATH", "/ratelimit/auth"), mm.ForwardAuthHandler())
+    root.Handle(getEnv("STATUS_PATH", "/ratelimit/status"), mm.StatusHandler())
+    hc := &health{store: store, timeout: getEnvAsSeconds("READY_TIMEOUT", 2)}
+    root.HandleFunc("/healthz", hc.liveness)
+    root.HandleFunc("/readyz", hc.readiness)
+    root.Handle("/", mm.Handler(mux))
+    handler := root
+
+    // server failures end the process just like a shutdown signal
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    var exitCode atomic.Int32
+    fail := func(msg string, err error) {
+        logger.Error(msg, "error", err)
+        exitCode.Store(1)
+        stop()
+    }
+
+    if watchUnblocks != nil {
+        go func() {
+            for {
+                err := watchUnblocks(ctx)
+                if errors.Is(err, storage.ErrUnblockUnsupported) {
+                    // only bolt gets here (see newStorage): it is single-node, so
+                    // there are no other instances to hear from
+                    return
+                }
+                if ctx.Err() != nil {
+                    return
+                }
+                // the watch should only end with ctx; wait before reconnecting even
+                // when it returned no error, so a closed subscription cannot spin
+                logger.Warn("watching unblocks stopped, retrying", "error", err)
+                select {
+                case <-ctx.Done():
+                    return
+                case <-time.After(5 * time.Second):
+                }
+            }
+        }()
+    }
 
-    addr := getEnv("SERVER_ADDR", "0.0.0.0:8080")
-    fmt.Printf("starting server on %s\n", addr)
-    log.Fatal(http.ListenAndServe(addr, handler))
+    // Envoy global rate limit service (gRPC), only when RLS_ADDR is set: the port is
+    // unauthenticated and its descriptors share counters with the HTTP path
+    var grpcServer *grpc.Server
+    if rlsAddr := os.Getenv("RLS_ADDR"); rlsAddr != "" {
+        lis, err := net.Listen("tcp", rlsAddr)
+        if err != nil {
+            logger.Error("rls listen failed", "addr", rlsAddr, "error", err)
+            os.Exit(1)
+        }
+        grpcServer = grpc.NewServer()
+        rlsv3.RegisterRateLimitServiceServer(grpcServer, rls.NewService(l))
+        go func() {
+            logger.Info("starting envoy rate limit service", "addr", rlsAddr)
+            if err := grpcServer.Serve(lis); err != nil {
+                fail("rls serve failed", err)
+            }
+        }()
+    }
+
+    srv := &http.Server{
+        Addr:              getEnv("SERVER_ADDR", "0.0.0.0:8080"),
+        Handler:           handler,
+        ReadTimeout:       getEnvAsSeconds("SERVER_READ_TIMEOUT", 15),
+        ReadHeaderTimeout: getEnvAsSeconds("SERVER_READ_HEADER_TIMEOUT", 5),
+        WriteTimeout:      getEnvAsSeconds("SERVER_WRITE_TIMEOUT", 30),
+        IdleTimeout:       getEnvAsSeconds("SERVER_IDLE_TIMEOUT", 120),
+        MaxHeaderBytes:    getEnvAsInt("SERVER_MAX_HEADER_BYTES", 1<<20),
+        ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+    }
+    go func() {
+        logger.Info("starting server", "addr", srv.Addr)
+        if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+            fail("server failed", err)
+        }
+    }()
+
+    <-ctx.Done()
+    stop()
+    hc.draining.Store(true)
+    // give load balancers time to see /readyz failing before connections are refused
+    time.Sleep(getEnvAsSeconds("SHUTDOWN_DELAY", 0))
+    logger.Info("shutting down, draining in-flight requests")
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), getEnvAsSeconds("SHUTDOWN_TIMEOUT", 30))
+    defer cancel()
+    if err := srv.Shutdown(shutdownCtx); err != nil {
+        logger.Error("http shutdown incomplete", "error", err)
+        exitCode.Store(1)
+    }
+
+    if grpcServer != nil {
+        grpcStopped := make(chan struct{})
+        go func() {
+            grpcServer.GracefulStop()
+            close(grpcStopped)
+        }()
+        select {
+        case <-grpcStopped:
+        case <-shutdownCtx.Done():
+            grpcServer.Stop()
+        }
+    }
+
+    if hybrid != nil {
+        if err := hybrid.Close(); err != nil {
+            logger.Error("flushing local counters", "error", err)
+        }
+    }
+    if err := base.Close(); err != nil {
+        logger.Error("closing storage", "error", err)
+    }
+    logger.Info("shutdown complete")
+    os.Exit(int(exitCode.Load()))
 }
 
 // minimal dotenv loader (only KEY=VALUE lines)
@@ -136,3 +289,7 @@ func getEnvAsInt(key string, fallback int) int {
     }
     return i
 }
+
+func getEnvAsSeconds(key string, fallback int) time.Duration {
+    return time.Duration(getEnvAsInt(key, fallback)) * time.Second
+}
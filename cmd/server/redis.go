@@ -0,0 +1,76 @@
+package main
+
+import (
+    "os"
+    "strings"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+)
+
+// newRedisStorage builds the Redis storage from env. REDIS_MODE selects the topology:
+//   - single:   one node at REDIS_ADDR (default)
+//   - cluster:  Redis Cluster seeded by REDIS_ADDRS (comma separated)
+//   - sentinel: master REDIS_MASTER_NAME discovered through the sentinels in REDIS_ADDRS
+//
+// REDIS_URL (redis:// or rediss://) can be used instead of the individual settings,
+// which take precedence when both are present. REDIS_ADDR is only the single-node
+// address when there is no URL, so a leftover default does not override the URL's host.
+func newRedisStorage() (*storage.RedisStorage, error) {
+    addrs := os.Getenv("REDIS_ADDRS")
+    if addrs == "" && os.Getenv("REDIS_URL") == "" {
+        addrs = os.Getenv("REDIS_ADDR")
+    }
+    cfg := storage.RedisConfig{
+        Mode:             getEnv("REDIS_MODE", "single"),
+        URL:              os.Getenv("REDIS_URL"),
+        KeyPrefix:        os.Getenv("REDIS_KEY_PREFIX"),
+        Addrs:            splitList(addrs),
+        Username:         os.Getenv("REDIS_USERNAME"),
+        Password:         os.Getenv("REDIS_PASSWORD"),
+        DB:               getEnvAsIntPtr("REDIS_DB"),
+        MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+        SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+
+        TLS:                   getEnv("REDIS_TLS", "false") == "true",
+        TLSCAFile:             os.Getenv("REDIS_TLS_CA_FILE"),
+        TLSCertFile:           os.Getenv("REDIS_TLS_CERT_FILE"),
+        TLSKeyFile:            os.Getenv("REDIS_TLS_KEY_FILE"),
+        TLSServerName:         os.Getenv("REDIS_TLS_SERVER_NAME"),
+        TLSInsecureSkipVerify: getEnv("REDIS_TLS_INSECURE_SKIP_VERIFY", "false") == "true",
+
+        PoolSize:     getEnvAsInt("REDIS_POOL_SIZE", 0),
+        MinIdleConns: getEnvAsInt("REDIS_MIN_IDLE_CONNS", 0),
+        DialTimeout:  getEnvAsMillis("REDIS_DIAL_TIMEOUT_MS", 0),
+        ReadTimeout:  getEnvAsMillis("REDIS_READ_TIMEOUT_MS", 0),
+        WriteTimeout: getEnvAsMillis("REDIS_WRITE_TIMEOUT_MS", 0),
+    }
+    return storage.NewRedisStorageFromConfig(cfg)
+}
+
+func splitList(raw string) []string {
+    var out []string
+    for _, p := range strings.Split(raw, ",") {
+        if p = strings.TrimSpace(p); p != "" {
+            out = append(out, p)
+        }
+    }
+    return out
+}
+
+func getEnvAsMillis(key string, fallback int) time.Duration {
+    return time.Duration(getEnvAsInt(key, fallback)) * time.Millisecond
+}
+
+// getEnvAsIntPtr is like getEnvAsInt, but tells an unset (or invalid) variable apart
+// from 0 by returning nil.
+func getEnvAsIntPtr(key string) *int {
+    if os.Getenv(key) == "" {
+        return nil
+    }
+    i := getEnvAsInt(key, -1)
+    if i < 0 {
+        return nil
+    }
+    return &i
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+
+    "github.com/bradfitz/gomemcache/memcache"
+    _ "github.com/jackc/pgx/v5/stdlib"
+    _ "modernc.org/sqlite"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+)
+
+// backend is a storage the server owns and closes on shutdown.
+type backend interface {
+    storage.Storage
+    Close() error
+}
+
+// newStorage builds the backend selected by STORAGE_BACKEND:
+//   - redis: shared Redis, see newRedisStorage (default)
+//   - bolt:  embedded bbolt file at BOLT_PATH, for a single node without Redis
+//   - sql:   SQL_DSN opened with SQL_DRIVER (pgx for PostgreSQL, sqlite for SQLite)
+//   - memcached: the servers in MEMCACHED_SERVERS (comma separated)
+//
+// CONCURRENCY_LIMIT needs a backend implementing storage.Semaphore; any other is
+// rejected here rather than failing every request. Local caches of blocks
+// (BLOCK_CACHE, HYBRID_FLUSH_INTERVAL_MS) need a shared backend to announce unblocks
+// (storage.UnblockWatcher), or an unblock on one instance would not reach the others.
+func newStorage() (backend, error) {
+    name := getEnv("STORAGE_BACKEND", "redis")
+    b, err := openStorage(name)
+    if err != nil {
+        return nil, err
+    }
+    if _, ok := b.(storage.Semaphore); !ok && getEnvAsInt("CONCURRENCY_LIMIT", 0) > 0 {
+        b.Close()
+        return nil, fmt.Errorf("STORAGE_BACKEND %q does not support CONCURRENCY_LIMIT", name)
+    }
+    if _, ok := b.(storage.UnblockWatcher); !ok && name != "bolt" && localBlockCache() {
+        // bolt is single-node: there are no other instances to tell
+        b.Close()
+        return nil, fmt.Errorf("STORAGE_BACKEND %q cannot announce unblocks: BLOCK_CACHE and HYBRID_FLUSH_INTERVAL_MS need redis", name)
+    }
+    return b, nil
+}
+
+// localBlockCache reports whether blocks are cached in process (see main).
+func localBlockCache() bool {
+    return getEnvAsMillis("HYBRID_FLUSH_INTERVAL_MS", 0) > 0 || getEnv("BLOCK_CACHE", "false") == "true"
+}
+
+func openStorage(name string) (backend, error) {
+    switch name {
+    case "redis":
+        return newRedisStorage()
+    case "bolt":
+        return storage.NewBoltStorage(getEnv("BOLT_PATH", "ratelimit.db"), getEnvAsSeconds("BOLT_COMPACT_INTERVAL", 60))
+    case "sql":
+        return newSQLStorage()
+    case "memcached":
+        return newMemcachedStorage()
+    default:
+        return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", name)
+    }
+}
+
+func newSQLStorage() (*storage.SQLStorage, error) {
+    db, err := sql.Open(getEnv("SQL_DRIVER", "pgx"), os.Getenv("SQL_DSN"))
+    if err != nil {
+        return nil, err
+    }
+    s, err := storage.NewSQLStorage(db, getEnvAsSeconds("SQL_CLEANUP_INTERVAL", 300))
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return s, nil
+}
+
+func newMemcachedStorage() (*storage.MemcachedStorage, error) {
+    servers := splitList(getEnv("MEMCACHED_SERVERS", "localhost:11211"))
+    if len(servers) == 0 {
+        return nil, fmt.Errorf("MEMCACHED_SERVERS is empty")
+    }
+    client := memcache.New(servers...)
+    if timeout := getEnvAsMillis("MEMCACHED_TIMEOUT_MS", 0); timeout > 0 {
+        client.Timeout = timeout
+    }
+    client.MaxIdleConns = getEnvAsInt("MEMCACHED_MAX_IDLE_CONNS", 0)
+    return storage.NewMemcachedStorage(client), nil
+}
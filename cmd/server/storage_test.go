@@ -0,0 +1,80 @@
+package main
+
+import (
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestNewStorage_RejectsConcurrencyWithoutSemaphore(t *testing.T) {
+    t.Setenv("STORAGE_BACKEND", "sql")
+    t.Setenv("SQL_DRIVER", "sqlite")
+    t.Setenv("SQL_DSN", "file:"+filepath.Join(t.TempDir(), "ratelimit.sqlite"))
+    t.Setenv("SQL_CLEANUP_INTERVAL", "0")
+
+    t.Setenv("CONCURRENCY_LIMIT", "1")
+    if _, err := newStorage(); err == nil || !strings.Contains(err.Error(), "CONCURRENCY_LIMIT") {
+        t.Fatalf("expected sql with CONCURRENCY_LIMIT to be rejected, got %v", err)
+    }
+
+    t.Setenv("CONCURRENCY_LIMIT", "0")
+    b, err := newStorage()
+    if err != nil {
+        t.Fatalf("expected sql without CONCURRENCY_LIMIT to work, got %v", err)
+    }
+    b.Close()
+}
+
+func TestNewStorage_AcceptsConcurrencyWithSemaphore(t *testing.T) {
+    t.Setenv("STORAGE_BACKEND", "bolt")
+    t.Setenv("BOLT_PATH", filepath.Join(t.TempDir(), "ratelimit.db"))
+    t.Setenv("CONCURRENCY_LIMIT", "1")
+
+    b, err := newStorage()
+    if err != nil {
+        t.Fatalf("expected bolt to support CONCURRENCY_LIMIT, got %v", err)
+    }
+    b.Close()
+}
+
+func TestNewStorage_RejectsConcurrencyWithMemcached(t *testing.T) {
+    t.Setenv("STORAGE_BACKEND", "memcached")
+    t.Setenv("MEMCACHED_SERVERS", "127.0.0.1:11211")
+    t.Setenv("CONCURRENCY_LIMIT", "1")
+
+    if _, err := newStorage(); err == nil || !strings.Contains(err.Error(), "CONCURRENCY_LIMIT") {
+        t.Fatalf("expected memcached with CONCURRENCY_LIMIT to be rejected, got %v", err)
+    }
+}
+
+func TestNewStorage_RejectsBlockCacheWithoutUnblockAnnouncements(t *testing.T) {
+    t.Setenv("STORAGE_BACKEND", "sql")
+    t.Setenv("SQL_DRIVER", "sqlite")
+    t.Setenv("SQL_DSN", "file:"+filepath.Join(t.TempDir(), "ratelimit.sqlite"))
+    t.Setenv("SQL_CLEANUP_INTERVAL", "0")
+
+    t.Setenv("BLOCK_CACHE", "true")
+    if _, err := newStorage(); err == nil || !strings.Contains(err.Error(), "BLOCK_CACHE") {
+        t.Fatalf("expected sql with BLOCK_CACHE to be rejected, got %v", err)
+    }
+    t.Setenv("BLOCK_CACHE", "false")
+    t.Setenv("HYBRID_FLUSH_INTERVAL_MS", "100")
+    if _, err := newStorage(); err == nil || !strings.Contains(err.Error(), "HYBRID_FLUSH_INTERVAL_MS") {
+        t.Fatalf("expected sql with the hybrid tier to be rejected, got %v", err)
+    }
+
+    t.Setenv("MEMCACHED_SERVERS", "127.0.0.1:11211")
+    t.Setenv("STORAGE_BACKEND", "memcached")
+    if _, err := newStorage(); err == nil {
+        t.Fatalf("expected memcached with the hybrid tier to be rejected")
+    }
+
+    // a single bolt node has no other instances to tell
+    t.Setenv("STORAGE_BACKEND", "bolt")
+    t.Setenv("BOLT_PATH", filepath.Join(t.TempDir(), "ratelimit.db"))
+    b, err := newStorage()
+    if err != nil {
+        t.Fatalf("expected bolt with the hybrid tier to work, got %v", err)
+    }
+    b.Close()
+}
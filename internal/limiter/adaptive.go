@@ -0,0 +1,89 @@
+package limiter
+
+import (
+    "math"
+    "sync"
+    "time"
+)
+
+// AdaptiveLimit scales configured limits up or down with AIMD (additive increase,
+// multiplicative decrease) based on the latency and error rate observed by the
+// middleware. Samples are evaluated in batches: a healthy batch adds Increase to the
+// scale, an unhealthy one multiplies it by Decrease, always within [Min, Max].
+// The scale is local to the process; counters stay shared in storage.
+type AdaptiveLimit struct {
+    mu    sync.Mutex
+    scale float64
+
+    Min      float64
+    Max      float64
+    Increase float64
+    Decrease float64
+
+    // LatencyTarget is the highest acceptable average latency of a batch.
+    LatencyTarget time.Duration
+    // ErrorRate is the highest acceptable fraction of failed requests in a batch.
+    ErrorRate float64
+    // SampleSize is the number of requests per batch.
+    SampleSize int
+
+    samples    int
+    failures   int
+    latencySum time.Duration
+}
+
+// NewAdaptiveLimit creates an AdaptiveLimit starting at scale 1 (the configured limits).
+func NewAdaptiveLimit() *AdaptiveLimit {
+    return &AdaptiveLimit{
+        scale:         1,
+        Min:           0.1,
+        Max:           2,
+        Increase:      0.05,
+        Decrease:      0.7,
+        LatencyTarget: 200 * time.Millisecond,
+        ErrorRate:     0.05,
+        SampleSize:    100,
+    }
+}
+
+// Record adds one observed request.
+func (a *AdaptiveLimit) Record(latency time.Duration, failed bool) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.samples++
+    a.latencySum += latency
+    if failed {
+        a.failures++
+    }
+    if a.samples < a.SampleSize {
+        return
+    }
+
+    avg := a.latencySum / time.Duration(a.samples)
+    errRate := float64(a.failures) / float64(a.samples)
+    if avg > a.LatencyTarget || errRate > a.ErrorRate {
+        a.scale = math.Max(a.Min, a.scale*a.Decrease)
+    } else {
+        a.scale = math.Min(a.Max, a.scale+a.Increase)
+    }
+    a.samples, a.failures, a.latencySum = 0, 0, 0
+}
+
+// Scale returns the current multiplier applied to configured limits.
+func (a *AdaptiveLimit) Scale() float64 {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    return a.scale
+}
+
+// apply scales limit, keeping at least 1 for positive limits.
+func (a *AdaptiveLimit) apply(limit int) int {
+    if limit <= 0 {
+        return limit
+    }
+    scaled := int(math.Round(float64(limit) * a.Scale()))
+    if scaled < 1 {
+        return 1
+    }
+    return scaled
+}
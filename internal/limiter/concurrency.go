@@ -0,0 +1,62 @@
+package limiter
+
+import (
+    "errors"
+    "sync"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+)
+
+// ErrConcurrencyUnsupported is returned when a concurrency limit is configured but the
+// storage does not implement storage.Semaphore.
+var ErrConcurrencyUnsupported = errors.New("limiter: storage does not support concurrency limits")
+
+// minConcurrencyLease is the shortest lease used; the lease is renewed every half of it.
+const minConcurrencyLease = time.Second
+
+// Acquire takes an in-flight slot for ip/apiKey (CONCURRENCY_LIMIT slots per identifier).
+// When ok is true, release must be called once the work is done; while held, the slot's
+// lease (CONCURRENCY_LEASE) is renewed in the background. With no concurrency limit
+// configured it always succeeds.
+func (l *Limiter) Acquire(ip, apiKey string) (release func(), ok bool, err error) {
+    if l.concurrencyLimit <= 0 {
+        return func() {}, true, nil
+    }
+    sem, isSem := l.store.(storage.Semaphore)
+    if !isSem {
+        return nil, false, ErrConcurrencyUnsupported
+    }
+
+    key := l.resolve("", ip, apiKey).key
+    lease := l.concurrencyLease
+    id, ok, err := sem.Acquire(key, l.concurrencyLimit, lease)
+    if err != nil || !ok {
+        return nil, false, err
+    }
+
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(lease / 2)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+                if held, err := sem.Refresh(key, id, lease); err == nil && !held {
+                    return
+                }
+            }
+        }
+    }()
+
+    var once sync.Once
+    release = func() {
+        once.Do(func() {
+            close(done)
+            _ = sem.Release(key, id)
+        })
+    }
+    return release, true, nil
+}
@@ -1,10 +1,16 @@
 package limiter
 
 import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
+    "log/slog"
+    "math"
     "os"
     "strconv"
     "strings"
+    "sync/atomic"
     "time"
 
     "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
@@ -25,6 +31,33 @@ type Limiter struct {
     defaultBlock  time.Duration
 
     tokenConfigs map[string]TokenConfig
+
+    // limits for outgoing requests per destination host (OUTBOUND_LIMITS)
+    hostConfigs map[string]TokenConfig
+
+    // block escalation for repeat offenders (disabled when factor <= 1)
+    escalationFactor   float64
+    escalationMax      time.Duration
+    escalationLookback time.Duration
+
+    // in-flight requests per identifier (disabled when 0)
+    concurrencyLimit int
+    concurrencyLease time.Duration
+
+    // scales limits from observed backend health (holds nil when ADAPTIVE is off);
+    // shared with tenant views
+    adaptive *atomic.Pointer[AdaptiveLimit]
+
+    logger *slog.Logger
+    // fraction of allowed requests that are logged
+    allowedSampleRate float64
+
+    // per-tenant default rules (TENANT_LIMITS) and the tenant of this view, if any
+    tenantConfigs map[string]TokenConfig
+    tenant        string
+
+    // HMAC key for API keys in storage keys and logs (raw tokens when empty)
+    tokenSecret []byte
 }
 
 // NewLimiter constructs a limiter reading environment variables for defaults.
@@ -36,10 +69,84 @@ func NewLimiter(store storage.Storage) *Limiter {
         defaultWindow: time.Duration(getEnvAsInt("DEFAULT_WINDOW", 1)) * time.Second,
         defaultBlock:  time.Duration(getEnvAsInt("DEFAULT_BLOCK", 300)) * time.Second,
         tokenConfigs:  parseTokenConfigs(getEnv("TOKEN_LIMITS", "")),
+        hostConfigs:   parseTokenConfigs(getEnv("OUTBOUND_LIMITS", "")),
+
+        escalationFactor:   getEnvAsFloat("BLOCK_ESCALATION_FACTOR", 1),
+        escalationMax:      time.Duration(getEnvAsInt("BLOCK_ESCALATION_MAX", 86400)) * time.Second,
+        escalationLookback: time.Duration(getEnvAsInt("BLOCK_ESCALATION_LOOKBACK", 3600)) * time.Second,
+
+        concurrencyLimit: getEnvAsInt("CONCURRENCY_LIMIT", 0),
+        concurrencyLease: time.Duration(getEnvAsInt("CONCURRENCY_LEASE", 30)) * time.Second,
+
+        logger:            slog.Default(),
+        allowedSampleRate: getEnvAsFloat("LOG_ALLOWED_SAMPLE_RATE", 0.01),
+
+        tenantConfigs: parseTokenConfigs(getEnv("TENANT_LIMITS", "")),
+        tokenSecret:   []byte(getEnv("TOKEN_HASH_SECRET", "")),
+        adaptive:      new(atomic.Pointer[AdaptiveLimit]),
+    }
+    if l.concurrencyLease < minConcurrencyLease {
+        l.concurrencyLease = minConcurrencyLease
+    }
+    if getEnv("ADAPTIVE", "false") == "true" {
+        a := NewAdaptiveLimit()
+        a.Min = getEnvAsFloat("ADAPTIVE_MIN", a.Min)
+        a.Max = getEnvAsFloat("ADAPTIVE_MAX", a.Max)
+        a.Increase = getEnvAsFloat("ADAPTIVE_INCREASE", a.Increase)
+        a.Decrease = getEnvAsFloat("ADAPTIVE_DECREASE", a.Decrease)
+        a.LatencyTarget = time.Duration(getEnvAsInt("ADAPTIVE_LATENCY_TARGET_MS", 200)) * time.Millisecond
+        a.ErrorRate = getEnvAsFloat("ADAPTIVE_ERROR_RATE", a.ErrorRate)
+        a.SampleSize = getEnvAsInt("ADAPTIVE_SAMPLE_SIZE", a.SampleSize)
+        l.adaptive.Store(a)
     }
     return l
 }
 
+// Tenant returns a view of the limiter for tenant: its counters and blocks are kept
+// apart from other tenants' in the same backend, and its default limit, window and
+// block come from TENANT_LIMITS when configured there. Token limits are shared.
+func (l *Limiter) Tenant(id string) *Limiter {
+    if id == "" {
+        return l
+    }
+    t := *l
+    t.tenant = id
+    if c, ok := l.tenantConfigs[id]; ok {
+        t.defaultLimit = c.Limit
+        t.defaultWindow = c.Window
+        t.defaultBlock = c.Block
+    }
+    return &t
+}
+
+// HasTenant reports whether id has its own limits in TENANT_LIMITS.
+func (l *Limiter) HasTenant(id string) bool {
+    _, ok := l.tenantConfigs[id]
+    return id != "" && ok
+}
+
+// HasToken reports whether apiKey has its own limits in TOKEN_LIMITS.
+func (l *Limiter) HasToken(apiKey string) bool {
+    _, ok := l.tokenConfigs[apiKey]
+    return apiKey != "" && ok
+}
+
+// SetAdaptive enables adaptive limits with the given controller (nil disables them).
+// It is safe to call while requests are being checked.
+func (l *Limiter) SetAdaptive(a *AdaptiveLimit) {
+    l.adaptive.Store(a)
+}
+
+// Observe reports the latency and outcome of a handled request to the adaptive
+// controller. It is a no-op when adaptive limits are disabled. Only callers that see
+// the protected backend do the work should report: the HTTP middleware and the unary
+// gRPC interceptor do, forward auth and the Envoy RLS cannot.
+func (l *Limiter) Observe(latency time.Duration, failed bool) {
+    if a := l.adaptive.Load(); a != nil {
+        a.Record(latency, failed)
+    }
+}
+
 func getEnv(key, fallback string) string {
     v := os.Getenv(key)
     if v == "" {
@@ -60,6 +167,18 @@ func getEnvAsInt(key string, fallback int) int {
     return i
 }
 
+func getEnvAsFloat(key string, fallback float64) float64 {
+    v := os.Getenv(key)
+    if v == "" {
+        return fallback
+    }
+    f, err := strconv.ParseFloat(v, 64)
+    if err != nil {
+        return fallback
+    }
+    return f
+}
+
 // TOKEN_LIMITS format: token:limit:window:block,token2:...
 func parseTokenConfigs(raw string) map[string]TokenConfig {
     out := map[string]TokenConfig{}
@@ -100,15 +219,40 @@ func parseTokenConfigs(raw string) map[string]TokenConfig {
 
 type AllowResult struct {
     Allowed     bool
-    Count       int64
+    Count       int64 // zero when the identifier was already blocked: it is not read then
     Limit       int
+    Window      time.Duration
     Blocked     bool
     BlockRemain time.Duration
+    ResetIn     time.Duration // until the window resets, for rejections that do not block
 }
 
-// Allow checks whether a request for given ip and apiKey is allowed. If apiKey is non-empty
-// and a token config exists, token config overrides IP limits.
-func (l *Limiter) Allow(ip string, apiKey string) (AllowResult, error) {
+// Remaining returns how many requests are still available in the current window; none
+// while blocked.
+func (r AllowResult) Remaining() int64 {
+    if r.Blocked {
+        return 0
+    }
+    rem := int64(r.Limit) - r.Count
+    if rem < 0 {
+        return 0
+    }
+    return rem
+}
+
+// rule is the storage key and limits that apply to a single request.
+type rule struct {
+    name   string // ip | token | token-required, for logs
+    scope  string
+    key    string
+    limit  int
+    window time.Duration
+    block  time.Duration
+}
+
+// resolve picks the rule for ip/apiKey. If apiKey is non-empty and a token config
+// exists, token config overrides IP limits.
+func (l *Limiter) resolve(scope, ip, apiKey string) rule {
     // decide strategy
     useToken := false
     var cfg TokenConfig
@@ -119,28 +263,75 @@ func (l *Limiter) Allow(ip string, apiKey string) (AllowResult, error) {
         }
     }
 
-    var key string
-    var limit int
-    var window time.Duration
-    var block time.Duration
-
+    var r rule
     if useToken {
-        key = fmt.Sprintf("token:%s", apiKey)
-        limit = cfg.Limit
-        window = cfg.Window
-        block = cfg.Block
+        r = rule{name: "token", key: fmt.Sprintf("token:%s", l.tokenID(apiKey)), limit: cfg.Limit, window: cfg.Window, block: cfg.Block}
     } else if l.mode == "token" {
         // if mode is token-only and no token present, use default deny by setting limit 0
-        key = fmt.Sprintf("ip:%s", ip)
-        limit = 0
-        window = l.defaultWindow
-        block = l.defaultBlock
+        r = rule{name: "token-required", key: fmt.Sprintf("ip:%s", ip), limit: 0, window: l.defaultWindow, block: l.defaultBlock}
     } else {
-        key = fmt.Sprintf("ip:%s", ip)
-        limit = l.defaultLimit
-        window = l.defaultWindow
-        block = l.defaultBlock
+        r = rule{name: "ip", key: fmt.Sprintf("ip:%s", ip), limit: l.defaultLimit, window: l.defaultWindow, block: l.defaultBlock}
+    }
+
+    if scope != "" {
+        r.scope = scope
+        r.key = scope + "|" + r.key
+    }
+    if l.tenant != "" {
+        r.key = "tenant:" + l.tenant + "|" + r.key
+    }
+    if a := l.adaptive.Load(); a != nil {
+        r.limit = a.apply(r.limit)
+    }
+    return r
+}
+
+// tokenID is how an API key appears in storage keys and logs: an HMAC-SHA256 of the
+// key (first 128 bits, hex) when TOKEN_HASH_SECRET is set, so raw secrets never
+// reach the backend; the key itself otherwise.
+func (l *Limiter) tokenID(apiKey string) string {
+    if len(l.tokenSecret) == 0 {
+        return apiKey
+    }
+    mac := hmac.New(sha256.New, l.tokenSecret)
+    mac.Write([]byte(apiKey))
+    return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Allow checks whether a request for given ip and apiKey is allowed. If apiKey is non-empty
+// and a token config exists, token config overrides IP limits.
+func (l *Limiter) Allow(ip string, apiKey string) (AllowResult, error) {
+    return l.AllowScoped("", ip, apiKey)
+}
+
+// AllowN is like Allow for a request that costs n units of the budget.
+func (l *Limiter) AllowN(ip string, apiKey string, n int64) (AllowResult, error) {
+    return l.AllowScopedN("", ip, apiKey, n)
+}
+
+// AllowScoped is like Allow but keeps separate counters per scope (e.g. a route or
+// an RPC method), so the same client has an independent budget in each scope.
+// Limits are resolved exactly as in Allow.
+func (l *Limiter) AllowScoped(scope, ip, apiKey string) (AllowResult, error) {
+    return l.AllowScopedN(scope, ip, apiKey, 1)
+}
+
+// AllowScopedN is AllowScoped for a request that costs n units (n < 1 counts as 1).
+// A cost above the limit is rejected without being counted or blocking the client.
+func (l *Limiter) AllowScopedN(scope, ip, apiKey string, n int64) (AllowResult, error) {
+    if n < 1 {
+        n = 1
+    }
+    rl := l.resolve(scope, ip, apiKey)
+    res, err := l.allow(rl, n)
+    if err == nil {
+        l.logDecision(rl, res)
     }
+    return res, err
+}
+
+func (l *Limiter) allow(rl rule, n int64) (AllowResult, error) {
+    key, limit, window, block := rl.key, rl.limit, rl.window, rl.block
 
     // check blocked
     blocked, rem, err := l.store.IsBlocked(key)
@@ -148,25 +339,175 @@ func (l *Limiter) Allow(ip string, apiKey string) (AllowResult, error) {
         return AllowResult{}, err
     }
     if blocked {
-        return AllowResult{Allowed: false, Blocked: true, BlockRemain: rem}, nil
+        // the count is not read: blocked traffic is answered without another round trip
+        return AllowResult{Allowed: false, Limit: limit, Window: window, Blocked: true, BlockRemain: rem}, nil
     }
 
     // if limit is 0, disallow
     if limit <= 0 {
         // set block and return
-        _ = l.store.SetBlocked(key, block)
-        return AllowResult{Allowed: false, Limit: limit, Count: 0, Blocked: true, BlockRemain: block}, nil
+        block = l.penalize(rl)
+        return AllowResult{Allowed: false, Limit: limit, Window: window, Count: 0, Blocked: true, BlockRemain: block}, nil
     }
 
-    cnt, err := l.store.Increment(key, window)
+    // a cost above the whole limit never fits in a window: reject it without charging
+    // it or blocking the client, who may have sent nothing else
+    if n > int64(limit) {
+        cnt, _, err := l.store.Get(key)
+        if err != nil {
+            return AllowResult{}, err
+        }
+        return AllowResult{Allowed: false, Count: cnt, Limit: limit, Window: window}, nil
+    }
+
+    var cnt int64
+    if n == 1 {
+        cnt, err = l.store.Increment(key, window)
+    } else {
+        cnt, err = l.store.IncrementBy(key, n, window)
+    }
     if err != nil {
         return AllowResult{}, err
     }
     if int(cnt) > limit {
         // exceed -> block
-        _ = l.store.SetBlocked(key, block)
-        return AllowResult{Allowed: false, Count: cnt, Limit: limit, Blocked: true, BlockRemain: block}, nil
+        block = l.penalize(rl)
+        return AllowResult{Allowed: false, Count: cnt, Limit: limit, Window: window, Blocked: true, BlockRemain: block}, nil
+    }
+
+    return AllowResult{Allowed: true, Count: cnt, Limit: limit, Window: window, Blocked: false}, nil
+}
+
+// penalize blocks the rule's key after a violation and returns the block duration.
+// With escalation enabled, every offense within the lookback period multiplies the
+// block by the escalation factor (capped at the configured maximum). The offense
+// count lives in storage under "offenses:<key>"; on storages implementing
+// storage.Toucher every offense moves its expiry to the lookback past the end of the
+// new block, so the history only decays once the client stays clean that long.
+func (l *Limiter) penalize(rl rule) time.Duration {
+    d := rl.block
+    if l.escalationFactor > 1 {
+        key := "offenses:" + rl.key
+        n, err := l.store.IncrementBy(key, 1, l.escalationLookback)
+        if err == nil {
+            if n > 1 {
+                d = escalate(rl.block, l.escalationFactor, n-1, l.escalationMax)
+            }
+            if t, ok := l.store.(storage.Toucher); ok {
+                _ = t.Touch(key, d+l.escalationLookback)
+            }
+        }
+    }
+    _ = l.store.SetBlocked(rl.key, d)
+    l.logger.Warn("identifier blocked", "identifier", l.logKey(rl.key), "rule", rl.name, "scope", rl.scope, "block", d)
+    return d
+}
+
+// escalate returns base * factor^repeats, capped at max (never below base; no cap
+// when max <= 0).
+func escalate(base time.Duration, factor float64, repeats int64, max time.Duration) time.Duration {
+    if max > 0 && max < base {
+        max = base
+    }
+    f := float64(base) * math.Pow(factor, float64(repeats))
+    if max > 0 && f >= float64(max) {
+        return max
+    }
+    if f >= float64(math.MaxInt64) || math.IsNaN(f) {
+        return time.Duration(math.MaxInt64)
+    }
+    return time.Duration(f)
+}
+
+// BlockScoped blocks the identifier resolved from scope/ip/apiKey for d, or for the
+// rule's block duration when d is zero.
+func (l *Limiter) BlockScoped(scope, ip, apiKey string, d time.Duration) error {
+    rl := l.resolve(scope, ip, apiKey)
+    if d <= 0 {
+        d = rl.block
+    }
+    return l.store.SetBlocked(rl.key, d)
+}
+
+// UnblockScoped lifts a block on the identifier resolved from scope/ip/apiKey before it
+// expires. Its counter is left as is. It returns storage.ErrUnblockUnsupported when the
+// storage does not implement storage.Unblocker.
+func (l *Limiter) UnblockScoped(scope, ip, apiKey string) error {
+    u, ok := l.store.(storage.Unblocker)
+    if !ok {
+        return storage.ErrUnblockUnsupported
+    }
+    return u.Unblock(l.resolve(scope, ip, apiKey).key)
+}
+
+// StatusResult is a read-only view of an identifier's budget. ResetIn is the time left
+// in the current window (zero when no requests were counted).
+type StatusResult struct {
+    Count       int64
+    Limit       int
+    Remaining   int64
+    Window      time.Duration
+    ResetIn     time.Duration
+    Blocked     bool
+    BlockRemain time.Duration
+}
+
+// Status reports the current budget for ip/apiKey without consuming it.
+func (l *Limiter) Status(ip string, apiKey string) (StatusResult, error) {
+    return l.StatusScoped("", ip, apiKey)
+}
+
+// StatusScoped is Status for counters kept by AllowScoped.
+func (l *Limiter) StatusScoped(scope, ip, apiKey string) (StatusResult, error) {
+    rl := l.resolve(scope, ip, apiKey)
+
+    blocked, rem, err := l.store.IsBlocked(rl.key)
+    if err != nil {
+        return StatusResult{}, err
+    }
+    cnt, ttl, err := l.store.Get(rl.key)
+    if err != nil {
+        return StatusResult{}, err
+    }
+
+    st := StatusResult{Count: cnt, Limit: rl.limit, Window: rl.window, ResetIn: ttl, Blocked: blocked, BlockRemain: rem}
+    if !blocked && int64(rl.limit) > cnt {
+        st.Remaining = int64(rl.limit) - cnt
     }
+    return st, nil
+}
+
+// FailuresBlocked reports whether the identifier is blocked by RecordFailure in scope.
+func (l *Limiter) FailuresBlocked(scope, ip, apiKey string) (bool, time.Duration, error) {
+    return l.store.IsBlocked(l.resolve(scope, ip, apiKey).key)
+}
+
+// RecordFailure counts a failed attempt (e.g. a 401 on a login route) for the identifier
+// in scope, blocking it for block once more than limit failures happen within window.
+// Only failures are counted, so it does not share budget with Allow.
+func (l *Limiter) RecordFailure(scope, ip, apiKey string, limit int, window, block time.Duration) (AllowResult, error) {
+    rl := l.resolve(scope, ip, apiKey)
+    rl.limit, rl.window, rl.block = limit, window, block
+
+    cnt, err := l.store.Increment(rl.key, rl.window)
+    if err != nil {
+        return AllowResult{}, err
+    }
+    if int(cnt) > rl.limit {
+        d := l.penalize(rl)
+        return AllowResult{Allowed: false, Count: cnt, Limit: limit, Window: window, Blocked: true, BlockRemain: d}, nil
+    }
+    return AllowResult{Allowed: true, Count: cnt, Limit: limit, Window: window}, nil
+}
+
+// AddUsage adds n (which may be negative) to a free-form usage counter for the
+// identifier in scope, e.g. transferred bytes, and returns the new total. The counter
+// resets window after it was created.
+func (l *Limiter) AddUsage(scope, ip, apiKey string, n int64, window time.Duration) (int64, error) {
+    return l.store.IncrementBy(l.resolve(scope, ip, apiKey).key, n, window)
+}
 
-    return AllowResult{Allowed: true, Count: cnt, Limit: limit, Blocked: false}, nil
+// Usage returns the usage counter for the identifier in scope and the time until it resets.
+func (l *Limiter) Usage(scope, ip, apiKey string) (int64, time.Duration, error) {
+    return l.store.Get(l.resolve(scope, ip, apiKey).key)
 }
@@ -1,65 +1,19 @@
 package limiter
 
 import (
+    "bytes"
+    "context"
+    "errors"
+    "log/slog"
+    "math"
     "os"
-    "sync"
+    "strings"
     "testing"
     "time"
-)
-
-// mockStorage is a simple in-memory implementation of storage.Storage for tests.
-type mockStorage struct {
-    mu       sync.Mutex
-    counters map[string]struct{
-        count int64
-        exp   time.Time
-    }
-    blocked map[string]time.Time
-}
-
-func newMockStorage() *mockStorage {
-    return &mockStorage{
-        counters: make(map[string]struct{count int64; exp time.Time}),
-        blocked:  make(map[string]time.Time),
-    }
-}
-
-func (m *mockStorage) Increment(key string, window time.Duration) (int64, error) {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    now := time.Now()
-    c, ok := m.counters[key]
-    if !ok || now.After(c.exp) {
-        // reset
-        m.counters[key] = struct{count int64; exp time.Time}{count: 1, exp: now.Add(window)}
-        return 1, nil
-    }
-    c.count++
-    m.counters[key] = c
-    return c.count, nil
-}
-
-func (m *mockStorage) SetBlocked(key string, duration time.Duration) error {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    m.blocked[key] = time.Now().Add(duration)
-    return nil
-}
 
-func (m *mockStorage) IsBlocked(key string) (bool, time.Duration, error) {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    exp, ok := m.blocked[key]
-    if !ok {
-        return false, 0, nil
-    }
-    now := time.Now()
-    if now.After(exp) {
-        delete(m.blocked, key)
-        return false, 0, nil
-    }
-    return true, exp.Sub(now), nil
-}
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
 
 func TestAllowByIP_ExceedAndBlock(t *testing.T) {
     // configure env for limiter
@@ -68,7 +22,7 @@ func TestAllowByIP_ExceedAndBlock(t *testing.T) {
     os.Setenv("DEFAULT_WINDOW", "10") // long window so counts persist during test
     os.Setenv("DEFAULT_BLOCK", "5")
 
-    ms := newMockStorage()
+    ms := storagetest.NewMemory()
     l := NewLimiter(ms)
 
     ip := "1.2.3.4"
@@ -110,7 +64,7 @@ func TestAllowByToken_OverridesIP(t *testing.T) {
     os.Setenv("DEFAULT_BLOCK", "5")
     os.Setenv("TOKEN_LIMITS", "tok1:3:10:5")
 
-    ms := newMockStorage()
+    ms := storagetest.NewMemory()
     l := NewLimiter(ms)
 
     ip := "9.9.9.9"
@@ -143,7 +97,7 @@ func TestTokenMode_WithoutToken_Denied(t *testing.T) {
     os.Setenv("DEFAULT_WINDOW", "1")
     os.Setenv("DEFAULT_BLOCK", "5")
 
-    ms := newMockStorage()
+    ms := storagetest.NewMemory()
     l := NewLimiter(ms)
 
     ip := "8.8.8.8"
@@ -155,3 +109,473 @@ func TestTokenMode_WithoutToken_Denied(t *testing.T) {
         t.Fatalf("in token-only mode without token expected deny+block, got %+v", res)
     }
 }
+
+func TestReserve_CancelGivesSlotBack(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := NewLimiter(storagetest.NewMemory())
+
+    r1, err := l.Reserve("worker")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !r1.OK() || r1.Delay() != 0 {
+        t.Fatalf("expected first reservation to hold a slot, got ok=%v delay=%v", r1.OK(), r1.Delay())
+    }
+
+    r2, err := l.Reserve("worker")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if r2.OK() || r2.Delay() <= 0 || r2.Delay() > 10*time.Second {
+        t.Fatalf("expected second reservation to wait for the window, got ok=%v delay=%v", r2.OK(), r2.Delay())
+    }
+
+    if err := r1.Cancel(); err != nil {
+        t.Fatalf("unexpected cancel error: %v", err)
+    }
+    r3, err := l.Reserve("worker")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !r3.OK() {
+        t.Fatalf("expected slot to be available after cancel")
+    }
+
+    // reserving over the limit must not block the identifier
+    if blocked, _, _ := l.store.IsBlocked("reserve|ip:worker"); blocked {
+        t.Fatalf("reserve should not block the identifier")
+    }
+    // reservations do not use up the budget of an HTTP client with the same identifier
+    if res, _ := l.Allow("worker", ""); !res.Allowed {
+        t.Fatalf("expected the ip:worker budget untouched, got %+v", res)
+    }
+}
+
+func TestReserve_CancelAfterWindowEndsKeepsNextWindow(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "1")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := NewLimiter(storagetest.NewMemory())
+    r1, _ := l.Reserve("worker")
+    if !r1.OK() {
+        t.Fatalf("expected first reservation to hold a slot")
+    }
+    time.Sleep(1100 * time.Millisecond)
+    if err := r1.Cancel(); err != nil {
+        t.Fatalf("unexpected cancel error: %v", err)
+    }
+    if r, _ := l.Reserve("worker"); !r.OK() {
+        t.Fatalf("expected a slot in the new window")
+    }
+    if r, _ := l.Reserve("worker"); r.OK() {
+        t.Fatalf("expected the late cancel not to add a slot to the new window")
+    }
+}
+
+func TestWait_BlocksUntilWindowResets(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "1")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := NewLimiter(storagetest.NewMemory())
+    ctx := context.Background()
+
+    if err := l.Wait(ctx, "worker"); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    start := time.Now()
+    if err := l.Wait(ctx, "worker"); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+        t.Fatalf("expected Wait to block until the window reset, took %v", elapsed)
+    }
+
+    // context deadline ends the wait
+    short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+    defer cancel()
+    if err := l.Wait(short, "worker"); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("expected deadline exceeded, got %v", err)
+    }
+}
+
+func TestWait_NoAllowanceInTokenMode(t *testing.T) {
+    os.Setenv("MODE", "token")
+    os.Setenv("TOKEN_LIMITS", "")
+
+    l := NewLimiter(storagetest.NewMemory())
+    if err := l.Wait(context.Background(), "unknown"); !errors.Is(err, ErrNoAllowance) {
+        t.Fatalf("expected ErrNoAllowance, got %v", err)
+    }
+}
+
+func TestAllowN_ConsumesCost(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "10")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := NewLimiter(storagetest.NewMemory())
+    ip := "7.7.7.7"
+
+    res, err := l.AllowN(ip, "", 6)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !res.Allowed || res.Count != 6 || res.Remaining() != 4 {
+        t.Fatalf("expected 6 units consumed, got %+v", res)
+    }
+
+    // 6 + 5 > 10 -> rejected and blocked
+    res, err = l.AllowN(ip, "", 5)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if res.Allowed || !res.Blocked {
+        t.Fatalf("expected expensive request to exceed the limit, got %+v", res)
+    }
+}
+
+func TestAllowN_CostAboveLimitIsNotChargedOrBlocked(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "10")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "300")
+
+    l := NewLimiter(storagetest.NewMemory())
+    ip := "7.7.7.8"
+
+    res, err := l.AllowN(ip, "", 11)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if res.Allowed || res.Blocked || res.Count != 0 || res.Limit != 10 {
+        t.Fatalf("expected an unblocked rejection with nothing charged, got %+v", res)
+    }
+
+    // the whole budget is still there
+    res, err = l.AllowN(ip, "", 10)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !res.Allowed || res.Count != 10 {
+        t.Fatalf("expected the full limit available after the rejection, got %+v", res)
+    }
+}
+
+func TestStatus_DoesNotConsume(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "3")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := NewLimiter(storagetest.NewMemory())
+    ip := "4.4.4.4"
+
+    st, err := l.Status(ip, "")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if st.Count != 0 || st.Remaining != 3 || st.Limit != 3 || st.Blocked {
+        t.Fatalf("unexpected initial status: %+v", st)
+    }
+
+    if _, err := l.Allow(ip, ""); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    for i := 0; i < 3; i++ {
+        st, err = l.Status(ip, "")
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+    }
+    if st.Count != 1 || st.Remaining != 2 || st.ResetIn <= 0 || st.ResetIn > 10*time.Second {
+        t.Fatalf("expected status after one request, got %+v", st)
+    }
+
+    for i := 0; i < 3; i++ {
+        _, _ = l.Allow(ip, "")
+    }
+    st, err = l.Status(ip, "")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !st.Blocked || st.Remaining != 0 || st.BlockRemain <= 0 {
+        t.Fatalf("expected blocked status, got %+v", st)
+    }
+}
+
+func TestBlockEscalation_RepeatOffenders(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "60")
+    os.Setenv("DEFAULT_BLOCK", "10")
+    os.Setenv("BLOCK_ESCALATION_FACTOR", "2")
+    os.Setenv("BLOCK_ESCALATION_MAX", "30")
+    os.Setenv("BLOCK_ESCALATION_LOOKBACK", "3600")
+    defer os.Unsetenv("BLOCK_ESCALATION_FACTOR")
+
+    ms := storagetest.NewMemory()
+    l := NewLimiter(ms)
+    ip := "3.3.3.3"
+
+    want := []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+    for i, w := range want {
+        _, _ = l.Allow(ip, "")
+        res, err := l.Allow(ip, "")
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        if !res.Blocked || res.BlockRemain != w {
+            t.Fatalf("offense %d: expected block of %v, got %+v", i+1, w, res)
+        }
+        // simulate the block and the counting window expiring
+        ms.Expire("ip:" + ip)
+    }
+
+    // once the offense history decays the base block applies again
+    ms.Expire("offenses:ip:" + ip)
+    _, _ = l.Allow(ip, "")
+    res, _ := l.Allow(ip, "")
+    if res.BlockRemain != 10*time.Second {
+        t.Fatalf("expected base block after history expired, got %v", res.BlockRemain)
+    }
+}
+
+func TestBlockEscalation_HistoryOutlivesEveryBlock(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "60")
+    os.Setenv("DEFAULT_BLOCK", "300")
+    os.Setenv("BLOCK_ESCALATION_FACTOR", "2")
+    os.Setenv("BLOCK_ESCALATION_MAX", "86400")
+    os.Setenv("BLOCK_ESCALATION_LOOKBACK", "3600")
+    defer os.Unsetenv("BLOCK_ESCALATION_FACTOR")
+
+    ms := storagetest.NewMemory()
+    l := NewLimiter(ms)
+    ip := "3.3.3.4"
+
+    block := 300 * time.Second
+    for i := 1; i <= 12; i++ {
+        _, _ = l.Allow(ip, "")
+        res, err := l.Allow(ip, "")
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        if !res.Blocked || res.BlockRemain != block {
+            t.Fatalf("offense %d: expected block of %v, got %+v", i, block, res)
+        }
+        // the history must still be there when the client offends again, up to a
+        // lookback after this block ends
+        if _, ttl, _ := ms.Get("offenses:ip:" + ip); ttl <= block+3599*time.Second {
+            t.Fatalf("offense %d: expected the history to last the block plus the lookback, got %v", i, ttl)
+        }
+        ms.Expire("ip:" + ip)
+        block = min(2*block, 86400*time.Second)
+    }
+}
+
+func TestAdaptiveLimit_AIMD(t *testing.T) {
+    a := NewAdaptiveLimit()
+    a.SampleSize = 10
+    a.LatencyTarget = 100 * time.Millisecond
+
+    // healthy batches increase additively up to Max
+    for i := 0; i < 10; i++ {
+        a.Record(10*time.Millisecond, false)
+    }
+    if got := a.Scale(); math.Abs(got-1.05) > 1e-9 {
+        t.Fatalf("expected scale 1.05 after a healthy batch, got %v", got)
+    }
+
+    // slow batch decreases multiplicatively
+    for i := 0; i < 10; i++ {
+        a.Record(500*time.Millisecond, false)
+    }
+    if got := a.Scale(); math.Abs(got-1.05*0.7) > 1e-9 {
+        t.Fatalf("expected scale %v after a slow batch, got %v", 1.05*0.7, got)
+    }
+
+    // failing batches bottom out at Min
+    for i := 0; i < 200; i++ {
+        a.Record(10*time.Millisecond, true)
+    }
+    if got := a.Scale(); got != a.Min {
+        t.Fatalf("expected scale at min %v, got %v", a.Min, got)
+    }
+}
+
+func TestAdaptiveLimit_ScalesEffectiveLimit(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "10")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := NewLimiter(storagetest.NewMemory())
+    a := NewAdaptiveLimit()
+    a.SampleSize = 1
+    l.SetAdaptive(a)
+
+    // two failing observations: 1 * 0.7 * 0.7 = 0.49 -> limit 5
+    l.Observe(time.Millisecond, true)
+    l.Observe(time.Millisecond, true)
+
+    res, err := l.Allow("2.2.2.2", "")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if res.Limit != 5 {
+        t.Fatalf("expected adaptive limit 5, got %+v", res)
+    }
+}
+
+func TestLogging_RejectionsWithMaskedToken(t *testing.T) {
+    os.Setenv("MODE", "both")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TOKEN_LIMITS", "secret-token:1:10:5")
+    os.Setenv("LOG_ALLOWED_SAMPLE_RATE", "0")
+    defer os.Unsetenv("LOG_ALLOWED_SAMPLE_RATE")
+
+    var buf bytes.Buffer
+    l := NewLimiter(storagetest.NewMemory())
+    l.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+    _, _ = l.Allow("1.1.1.1", "secret-token")
+    if buf.Len() != 0 {
+        t.Fatalf("expected allowed request not to be logged with sample rate 0, got %s", buf.String())
+    }
+    _, _ = l.Allow("1.1.1.1", "secret-token")
+
+    out := buf.String()
+    if strings.Contains(out, "secret-token") {
+        t.Fatalf("raw API key leaked into logs: %s", out)
+    }
+    if !strings.Contains(out, `"msg":"request rejected"`) || !strings.Contains(out, `"msg":"identifier blocked"`) {
+        t.Fatalf("expected rejection and block entries, got %s", out)
+    }
+    if !strings.Contains(out, `"identifier":"token:se****"`) || !strings.Contains(out, `"rule":"token"`) || !strings.Contains(out, `"limit":1`) {
+        t.Fatalf("expected identifier, rule and limit attributes, got %s", out)
+    }
+
+    // most rejections hit the existing block: they still carry the limit
+    buf.Reset()
+    res, _ := l.Allow("1.1.1.1", "secret-token")
+    if !res.Blocked || res.Limit != 1 || res.Window != 10*time.Second || res.Remaining() != 0 {
+        t.Fatalf("expected the rule's limit on a blocked rejection, got %+v", res)
+    }
+    out = buf.String()
+    if !strings.Contains(out, `"limit":1`) || strings.Contains(out, `"count"`) {
+        t.Fatalf("expected the limit and no made-up count, got %s", out)
+    }
+}
+
+func TestTenant_SeparateRulesAndCounters(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TENANT_LIMITS", "acme:3:10:5")
+    defer os.Unsetenv("TENANT_LIMITS")
+
+    ms := storagetest.NewMemory()
+    l := NewLimiter(ms)
+    ip := "5.6.7.8"
+
+    // acme has its own limit of 3
+    acme := l.Tenant("acme")
+    for i := 1; i <= 3; i++ {
+        res, err := acme.Allow(ip, "")
+        if err != nil || !res.Allowed {
+            t.Fatalf("expected acme request %d allowed, got %+v %v", i, res, err)
+        }
+    }
+    if res, _ := acme.Allow(ip, ""); res.Allowed {
+        t.Fatalf("expected acme to be limited after 3 requests")
+    }
+
+    // same IP under another tenant and without tenant has untouched counters
+    if res, _ := l.Tenant("globex").Allow(ip, ""); !res.Allowed || res.Limit != 1 {
+        t.Fatalf("expected globex to use defaults with its own counter, got %+v", res)
+    }
+    if res, _ := l.Allow(ip, ""); !res.Allowed {
+        t.Fatalf("expected untenanted counter to be independent, got %+v", res)
+    }
+    if blocked, _, _ := ms.IsBlocked("tenant:acme|ip:" + ip); !blocked {
+        t.Fatalf("expected acme block to be stored under the tenant key")
+    }
+}
+
+func TestTokenHashing_NoRawTokenInStorageOrLogs(t *testing.T) {
+    os.Setenv("MODE", "both")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TOKEN_LIMITS", "raw-secret-token:2:10:5")
+    os.Setenv("TOKEN_HASH_SECRET", "pepper")
+    defer os.Unsetenv("TOKEN_HASH_SECRET")
+
+    var buf bytes.Buffer
+    ms := storagetest.NewMemory()
+    l := NewLimiter(ms)
+    l.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+    // the configured token limit (2) still applies
+    for i := 1; i <= 2; i++ {
+        res, err := l.Allow("1.1.1.1", "raw-secret-token")
+        if err != nil || !res.Allowed || res.Limit != 2 {
+            t.Fatalf("expected token request %d allowed with limit 2, got %+v %v", i, res, err)
+        }
+    }
+    _, _ = l.Allow("1.1.1.1", "raw-secret-token")
+
+    keys := ms.Keys()
+
+    want := "token:" + l.tokenID("raw-secret-token")
+    found := false
+    for _, k := range keys {
+        if strings.Contains(k, "raw-secret-token") {
+            t.Fatalf("raw token stored in key %q", k)
+        }
+        if k == want {
+            found = true
+        }
+    }
+    if !found || len(want) != len("token:")+32 {
+        t.Fatalf("expected hashed key %q among %v", want, keys)
+    }
+    if strings.Contains(buf.String(), "raw-secret-token") || !strings.Contains(buf.String(), want) {
+        t.Fatalf("expected logs to carry the hashed token only, got %s", buf.String())
+    }
+}
+
+func TestUnblockScoped_LiftsCachedBlock(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "1")
+    os.Setenv("DEFAULT_BLOCK", "60")
+    os.Setenv("TOKEN_LIMITS", "")
+
+    l := NewLimiter(storage.NewBlockCache(storagetest.NewMemory()))
+    if err := l.BlockScoped("", "9.9.9.9", "", 0); err != nil {
+        t.Fatalf("block: %v", err)
+    }
+    if res, _ := l.Allow("9.9.9.9", ""); res.Allowed || !res.Blocked {
+        t.Fatalf("expected blocked, got %+v", res)
+    }
+    if err := l.UnblockScoped("", "9.9.9.9", ""); err != nil {
+        t.Fatalf("unblock: %v", err)
+    }
+    if res, _ := l.Allow("9.9.9.9", ""); !res.Allowed {
+        t.Fatalf("expected allowed after unblock, got %+v", res)
+    }
+}
@@ -0,0 +1,57 @@
+package limiter
+
+import (
+    "log/slog"
+    "math/rand/v2"
+    "strings"
+)
+
+// SetLogger replaces the logger used for limiter decisions (slog.Default by default).
+func (l *Limiter) SetLogger(logger *slog.Logger) {
+    l.logger = logger
+}
+
+// logDecision logs every rejection and a sample (LOG_ALLOWED_SAMPLE_RATE) of allowed requests.
+func (l *Limiter) logDecision(rl rule, res AllowResult) {
+    attrs := []any{
+        "identifier", l.logKey(rl.key),
+        "rule", rl.name,
+        "scope", rl.scope,
+        "limit", res.Limit,
+    }
+    if !res.Blocked || res.Count > 0 {
+        // a request turned away by an earlier block was not counted
+        attrs = append(attrs, "count", res.Count)
+    }
+    if !res.Allowed {
+        l.logger.Warn("request rejected", append(attrs, "blocked", res.Blocked, "block_remaining", res.BlockRemain)...)
+        return
+    }
+    if l.allowedSampleRate > 0 && rand.Float64() < l.allowedSampleRate {
+        l.logger.Info("request allowed", append(attrs, "remaining", res.Remaining())...)
+    }
+}
+
+// logKey returns key as it may be logged: hashed tokens are safe to show as they
+// are (and let logs be correlated with storage), raw ones are masked.
+func (l *Limiter) logKey(key string) string {
+    if len(l.tokenSecret) > 0 {
+        return key
+    }
+    return maskKey(key)
+}
+
+// maskKey hides API keys in storage keys ("token:abc123" -> "token:ab****") so
+// secrets don't end up in logs.
+func maskKey(key string) string {
+    idx := strings.Index(key, "token:")
+    if idx == -1 {
+        return key
+    }
+    tok := key[idx+len("token:"):]
+    visible := 2
+    if len(tok) <= 4 {
+        visible = 0
+    }
+    return key[:idx+len("token:")] + tok[:visible] + "****"
+}
@@ -0,0 +1,73 @@
+package limiter
+
+import "time"
+
+// resolveHost is the rule for outgoing requests to host: its OUTBOUND_LIMITS entry, or
+// the default limits. Hosts have their own config and "host:" keys, so a host name is
+// never mistaken for an API key and MODE does not apply to them.
+func (l *Limiter) resolveHost(host string) rule {
+    r := rule{name: "host", key: "host:" + host, limit: l.defaultLimit, window: l.defaultWindow, block: l.defaultBlock}
+    if c, ok := l.hostConfigs[host]; ok {
+        r.limit, r.window, r.block = c.Limit, c.Window, c.Block
+    }
+    if l.tenant != "" {
+        r.key = "tenant:" + l.tenant + "|" + r.key
+    }
+    return r
+}
+
+// AllowHost is Allow for an outgoing request to host. Going over the host's limit
+// does not block it: the request is rejected, not counted, and ResetIn tells when the
+// window resets. Only BlockHost (upstream 429s) blocks a host.
+func (l *Limiter) AllowHost(host string) (AllowResult, error) {
+    rl := l.resolveHost(host)
+    res, err := l.allowHost(rl)
+    if err == nil {
+        l.logDecision(rl, res)
+    }
+    return res, err
+}
+
+func (l *Limiter) allowHost(rl rule) (AllowResult, error) {
+    blocked, rem, err := l.store.IsBlocked(rl.key)
+    if err != nil {
+        return AllowResult{}, err
+    }
+    if blocked {
+        return AllowResult{Allowed: false, Limit: rl.limit, Window: rl.window, Blocked: true, BlockRemain: rem}, nil
+    }
+    if rl.limit <= 0 {
+        return AllowResult{Allowed: false, Limit: rl.limit, Window: rl.window, ResetIn: rl.window}, nil
+    }
+
+    cnt, err := l.store.IncrementBy(rl.key, 1, rl.window)
+    if err != nil {
+        return AllowResult{}, err
+    }
+    if int(cnt) <= rl.limit {
+        return AllowResult{Allowed: true, Count: cnt, Limit: rl.limit, Window: rl.window}, nil
+    }
+
+    // window is full: hand the slot back and report when it resets, as reserve does
+    live, ttl, err := l.windowLive(rl.key)
+    if err != nil {
+        return AllowResult{}, err
+    }
+    if err := l.rollback(rl.key, rl.window, live); err != nil {
+        return AllowResult{}, err
+    }
+    if ttl < minRetryDelay {
+        ttl = minRetryDelay
+    }
+    return AllowResult{Allowed: false, Count: cnt - 1, Limit: rl.limit, Window: rl.window, ResetIn: ttl}, nil
+}
+
+// BlockHost blocks outgoing requests to host for d, or for the host's block duration
+// when d is zero.
+func (l *Limiter) BlockHost(host string, d time.Duration) error {
+    rl := l.resolveHost(host)
+    if d <= 0 {
+        d = rl.block
+    }
+    return l.store.SetBlocked(rl.key, d)
+}
@@ -0,0 +1,161 @@
+package limiter
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+)
+
+// ErrNoAllowance is returned by Wait when the identifier's limit is zero, so no slot
+// will ever become available.
+var ErrNoAllowance = errors.New("limiter: identifier has no allowance")
+
+// minRetryDelay avoids busy loops when a window is about to expire.
+const minRetryDelay = 10 * time.Millisecond
+
+// reserveScope keeps Reserve and Wait counters apart from the ones of HTTP clients.
+const reserveScope = "reserve"
+
+// Reservation is the outcome of Reserve. When OK is true a slot in the current window
+// is held and can be handed back with Cancel; otherwise Delay tells how long to wait
+// before trying again. Unlike golang.org/x/time/rate, a reservation that could not get
+// a slot does not queue for a future one.
+type Reservation struct {
+    mu     sync.Mutex
+    l      *Limiter
+    key    string
+    window time.Duration
+    ok     bool
+    delay  time.Duration
+    limit  int
+    // the slot's window is known to run at least until then
+    live time.Time
+}
+
+// OK reports whether the reservation holds a slot.
+func (r *Reservation) OK() bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.ok
+}
+
+// Delay returns how long to wait before retrying; zero when OK.
+func (r *Reservation) Delay() time.Duration {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.delay
+}
+
+// Cancel gives the reserved slot back so another caller can use it. It is a no-op
+// for reservations that do not hold a slot or were already cancelled, and once the
+// slot's window has ended: the slot is free again anyway, and taking it back from
+// the next window would allow one request too many there.
+func (r *Reservation) Cancel() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if !r.ok {
+        return nil
+    }
+    r.ok = false
+    return r.l.rollback(r.key, r.window, r.live)
+}
+
+// Reserve tries to take a slot for key without blocking. The key is resolved like a
+// token first (TOKEN_LIMITS), falling back to the default limits, but counted apart
+// from HTTP clients with the same identifier. Exceeding the limit through Reserve or
+// Wait does not block the identifier.
+func (l *Limiter) Reserve(key string) (*Reservation, error) {
+    return l.reserve(l.resolve(reserveScope, key, key))
+}
+
+// windowLive returns a time until which the window of key is sure to run, from its
+// TTL; the zero time when the key is gone.
+func (l *Limiter) windowLive(key string) (time.Time, time.Duration, error) {
+    before := time.Now()
+    _, ttl, err := l.store.Get(key)
+    if err != nil || ttl <= 0 {
+        return time.Time{}, 0, err
+    }
+    return before.Add(ttl), ttl, nil
+}
+
+// rollback takes one increment back from key if its window still runs until live.
+func (l *Limiter) rollback(key string, window time.Duration, live time.Time) error {
+    if !time.Now().Before(live) {
+        return nil
+    }
+    _, err := l.store.IncrementBy(key, -1, window)
+    return err
+}
+
+func (l *Limiter) reserve(rl rule) (*Reservation, error) {
+    r := &Reservation{l: l, key: rl.key, window: rl.window, limit: rl.limit}
+
+    blocked, rem, err := l.store.IsBlocked(rl.key)
+    if err != nil {
+        return nil, err
+    }
+    if blocked {
+        r.delay = rem
+        return r, nil
+    }
+    if rl.limit <= 0 {
+        r.delay = rl.window
+        return r, nil
+    }
+
+    cnt, err := l.store.IncrementBy(rl.key, 1, rl.window)
+    if err != nil {
+        return nil, err
+    }
+    live, ttl, err := l.windowLive(rl.key)
+    if err != nil {
+        return nil, err
+    }
+    if int(cnt) <= rl.limit {
+        r.ok = true
+        r.live = live
+        return r, nil
+    }
+
+    // window is full: hand the slot back and report when it resets
+    if err := l.rollback(rl.key, rl.window, live); err != nil {
+        return nil, err
+    }
+    r.delay = ttl
+    if r.delay < minRetryDelay {
+        r.delay = minRetryDelay
+    }
+    return r, nil
+}
+
+// Wait blocks until a slot for key is available or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+    return l.wait(ctx, l.resolve(reserveScope, key, key))
+}
+
+func (l *Limiter) wait(ctx context.Context, rl rule) error {
+    for {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        r, err := l.reserve(rl)
+        if err != nil {
+            return err
+        }
+        if r.OK() {
+            return nil
+        }
+        if r.limit <= 0 {
+            return ErrNoAllowance
+        }
+        timer := time.NewTimer(r.Delay())
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return ctx.Err()
+        case <-timer.C:
+        }
+    }
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+// BlockCache is a Storage decorator that remembers blocked keys in process until their
+// block expires, so traffic from blocked clients is rejected without a backend call.
+// Keys are cached when SetBlocked succeeds or IsBlocked reports a block; keys that are
+// not blocked are always checked against the backend. Counters go straight through.
+//
+// A block lifted early with Unblock is dropped from this cache at once; other
+// instances drop it when Watch receives the backend's announcement. An answer the
+// backend gave before an invalidation is not cached after it, so a lookup racing
+// with the announcement cannot bring the lifted block back.
+type BlockCache struct {
+    Storage
+
+    now func() time.Time
+
+    mu        sync.Mutex
+    blocks    map[string]time.Time
+    nextSweep int
+    // epoch counts invalidations; backend answers from an older epoch are not cached
+    epoch uint64
+}
+
+// NewBlockCache wraps backend with a local cache of blocked keys.
+func NewBlockCache(backend Storage) *BlockCache {
+    return &BlockCache{
+        Storage: backend,
+        now:     time.Now,
+        blocks:  make(map[string]time.Time),
+    }
+}
+
+func (c *BlockCache) SetBlocked(key string, duration time.Duration) error {
+    epoch := c.currentEpoch()
+    if err := c.Storage.SetBlocked(key, duration); err != nil {
+        return err
+    }
+    c.remember(key, c.now().Add(duration), epoch)
+    return nil
+}
+
+func (c *BlockCache) IsBlocked(key string) (bool, time.Duration, error) {
+    now := c.now()
+    c.mu.Lock()
+    if until, ok := c.blocks[key]; ok {
+        if now.Before(until) {
+            c.mu.Unlock()
+            return true, until.Sub(now), nil
+        }
+        delete(c.blocks, key)
+    }
+    epoch := c.epoch
+    c.mu.Unlock()
+
+    blocked, ttl, err := c.Storage.IsBlocked(key)
+    if err != nil || !blocked {
+        return blocked, ttl, err
+    }
+    c.remember(key, now.Add(ttl), epoch)
+    return true, ttl, nil
+}
+
+// Unblock lifts the block in the backend and drops the key from the cache.
+func (c *BlockCache) Unblock(key string) error {
+    u, ok := c.Storage.(Unblocker)
+    if !ok {
+        return ErrUnblockUnsupported
+    }
+    if err := u.Unblock(key); err != nil {
+        return err
+    }
+    c.Invalidate(key)
+    return nil
+}
+
+// Invalidate drops key from the cache, so the next IsBlocked asks the backend.
+func (c *BlockCache) Invalidate(key string) {
+    c.mu.Lock()
+    delete(c.blocks, key)
+    c.epoch++
+    c.mu.Unlock()
+}
+
+func (c *BlockCache) currentEpoch() uint64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.epoch
+}
+
+// Watch invalidates keys unblocked by any instance until ctx is done. It needs a
+// backend implementing UnblockWatcher and is meant to run in its own goroutine.
+func (c *BlockCache) Watch(ctx context.Context) error {
+    w, ok := c.Storage.(UnblockWatcher)
+    if !ok {
+        return ErrUnblockUnsupported
+    }
+    return w.WatchUnblocks(ctx, c.Invalidate)
+}
+
+// remember caches a block read from the backend in epoch, unless a key was invalidated
+// since. It sweeps expired entries whenever the cache has doubled since the last sweep
+// so keys that are never looked up again do not pile up.
+func (c *BlockCache) remember(key string, until time.Time, epoch uint64) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if epoch != c.epoch {
+        return
+    }
+    c.blocks[key] = until
+    if len(c.blocks) < c.nextSweep {
+        return
+    }
+    now := c.now()
+    for k, u := range c.blocks {
+        if !now.Before(u) {
+            delete(c.blocks, k)
+        }
+    }
+    c.nextSweep = 2*len(c.blocks) + 64
+}
+
+func (c *BlockCache) Touch(key string, ttl time.Duration) error {
+    t, ok := c.Storage.(Toucher)
+    if !ok {
+        return ErrTouchUnsupported
+    }
+    return t.Touch(key, ttl)
+}
+
+func (c *BlockCache) Acquire(key string, limit int, lease time.Duration) (string, bool, error) {
+    sem, ok := c.Storage.(Semaphore)
+    if !ok {
+        return "", false, ErrSemaphoreUnsupported
+    }
+    return sem.Acquire(key, limit, lease)
+}
+
+func (c *BlockCache) Refresh(key, id string, lease time.Duration) (bool, error) {
+    sem, ok := c.Storage.(Semaphore)
+    if !ok {
+        return false, ErrSemaphoreUnsupported
+    }
+    return sem.Refresh(key, id, lease)
+}
+
+func (c *BlockCache) Release(key, id string) error {
+    sem, ok := c.Storage.(Semaphore)
+    if !ok {
+        return ErrSemaphoreUnsupported
+    }
+    return sem.Release(key, id)
+}
@@ -0,0 +1,120 @@
+package storage_test
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func TestBlockCache_AnswersBlockedKeysLocally(t *testing.T) {
+    backend := storagetest.NewMemory()
+    c := storage.NewBlockCache(backend)
+
+    if blocked, _, _ := c.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected not blocked")
+    }
+    if blocked, _, _ := c.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected not blocked")
+    }
+    if calls := backend.Calls(); calls != 2 {
+        t.Fatalf("expected unblocked keys to be checked in the backend every time, got %d calls", calls)
+    }
+
+    if err := c.SetBlocked("ip:1", time.Minute); err != nil {
+        t.Fatalf("set blocked: %v", err)
+    }
+    before := backend.Calls()
+    for i := 0; i < 10; i++ {
+        blocked, ttl, err := c.IsBlocked("ip:1")
+        if err != nil || !blocked || ttl <= 0 || ttl > time.Minute {
+            t.Fatalf("expected blocked, got %v %v %v", blocked, ttl, err)
+        }
+    }
+    if backend.Calls() != before {
+        t.Fatalf("expected blocked key answered without the backend")
+    }
+}
+
+func TestBlockCache_UnblockInvalidatesEveryInstance(t *testing.T) {
+    backend := storagetest.NewMemory()
+    a, b := storage.NewBlockCache(backend), storage.NewBlockCache(backend)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go b.Watch(ctx)
+
+    a.SetBlocked("ip:1", time.Minute)
+    if blocked, _, _ := b.IsBlocked("ip:1"); !blocked {
+        t.Fatalf("expected b to see the block")
+    }
+
+    // wait for b's watcher to be registered before unblocking
+    for deadline := time.Now().Add(time.Second); ; {
+        if backend.Watchers() == 1 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("watcher not registered")
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    if err := a.Unblock("ip:1"); err != nil {
+        t.Fatalf("unblock: %v", err)
+    }
+    if blocked, _, _ := a.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected a to drop the block")
+    }
+    if blocked, _, _ := b.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected b to drop the block after the announcement")
+    }
+}
+
+// racyStore runs during after the backend answered IsBlocked and before the cache
+// sees the answer.
+type racyStore struct {
+    *storagetest.Memory
+    during func()
+}
+
+func (r *racyStore) IsBlocked(key string) (bool, time.Duration, error) {
+    blocked, ttl, err := r.Memory.IsBlocked(key)
+    if r.during != nil {
+        r.during()
+    }
+    return blocked, ttl, err
+}
+
+func TestBlockCache_InvalidationDuringLookupIsNotUndone(t *testing.T) {
+    backend := &racyStore{Memory: storagetest.NewMemory()}
+    c := storage.NewBlockCache(backend)
+    backend.SetBlocked("ip:1", time.Minute)
+
+    // the unblock lands while the lookup is on its way back
+    backend.during = func() {
+        backend.Unblock("ip:1")
+        c.Invalidate("ip:1")
+    }
+    if blocked, _, _ := c.IsBlocked("ip:1"); !blocked {
+        t.Fatalf("expected the lookup to report what the backend answered")
+    }
+    backend.during = nil
+    if blocked, _, _ := c.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected the lifted block not to be cached")
+    }
+}
+
+func TestBlockCache_UnblockUnsupported(t *testing.T) {
+    // embedding hides Memory's Unblock and WatchUnblocks
+    c := storage.NewBlockCache(struct{ storage.Storage }{storagetest.NewMemory()})
+    if err := c.Unblock("k"); !errors.Is(err, storage.ErrUnblockUnsupported) {
+        t.Fatalf("expected storage.ErrUnblockUnsupported, got %v", err)
+    }
+    if err := c.Watch(context.Background()); !errors.Is(err, storage.ErrUnblockUnsupported) {
+        t.Fatalf("expected storage.ErrUnblockUnsupported from Watch, got %v", err)
+    }
+}
@@ -0,0 +1,336 @@
+package storage
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "sync"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+var (
+    boltCounters    = []byte("counters")
+    boltBlocks      = []byte("blocks")
+    boltConcurrency = []byte("concurrency")
+)
+
+// BoltStorage keeps counters, blocks and concurrency slots in an embedded bbolt file, so
+// they survive restarts on a single node without Redis. bbolt allows one process per
+// file; for several instances use Redis.
+//
+// Expired entries are ignored on read and removed by Compact, which runs every
+// compaction interval. Freed pages are reused by bbolt but the file does not shrink.
+type BoltStorage struct {
+    db  *bolt.DB
+    now func() time.Time
+
+    stop      chan struct{}
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+// NewBoltStorage opens (or creates) the bbolt file at path and starts compacting it every
+// compactInterval (no background compaction when not positive).
+func NewBoltStorage(path string, compactInterval time.Duration) (*BoltStorage, error) {
+    db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+    if err != nil {
+        return nil, err
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        for _, name := range [][]byte{boltCounters, boltBlocks, boltConcurrency} {
+            if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    b := &BoltStorage{db: db, now: time.Now, stop: make(chan struct{}), done: make(chan struct{})}
+    if compactInterval > 0 {
+        go b.run(compactInterval)
+    } else {
+        close(b.done)
+    }
+    return b, nil
+}
+
+func (b *BoltStorage) run(interval time.Duration) {
+    defer close(b.done)
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-b.stop:
+            return
+        case <-ticker.C:
+            _ = b.Compact()
+        }
+    }
+}
+
+// Close stops the compaction and closes the file.
+func (b *BoltStorage) Close() error {
+    b.closeOnce.Do(func() { close(b.stop) })
+    <-b.done
+    return b.db.Close()
+}
+
+// Ping fails once the file has been closed.
+func (b *BoltStorage) Ping(ctx context.Context) error {
+    return b.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+// counters are stored as count (8 bytes) followed by the expiry in unix nanoseconds.
+func encodeCounter(count int64, expires time.Time) []byte {
+    v := make([]byte, 16)
+    binary.BigEndian.PutUint64(v[:8], uint64(count))
+    binary.BigEndian.PutUint64(v[8:], uint64(expires.UnixNano()))
+    return v
+}
+
+func decodeCounter(v []byte) (int64, time.Time) {
+    if len(v) != 16 {
+        return 0, time.Time{}
+    }
+    return int64(binary.BigEndian.Uint64(v[:8])), time.Unix(0, int64(binary.BigEndian.Uint64(v[8:])))
+}
+
+func encodeExpiry(t time.Time) []byte {
+    v := make([]byte, 8)
+    binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+    return v
+}
+
+func decodeExpiry(v []byte) time.Time {
+    if len(v) != 8 {
+        return time.Time{}
+    }
+    return time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+}
+
+func (b *BoltStorage) Increment(key string, window time.Duration) (int64, error) {
+    return b.IncrementBy(key, 1, window)
+}
+
+func (b *BoltStorage) IncrementBy(key string, n int64, window time.Duration) (int64, error) {
+    var count int64
+    err := b.db.Update(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket(boltCounters)
+        now := b.now()
+        current, expires := decodeCounter(bucket.Get([]byte(key)))
+        if !now.Before(expires) {
+            if n < 0 {
+                // nothing to take from: no window starts
+                count = 0
+                return nil
+            }
+            // missing or expired: a new window starts
+            current, expires = 0, now.Add(window)
+        }
+        count = current + n
+        if count < 0 {
+            count = 0
+        }
+        return bucket.Put([]byte(key), encodeCounter(count, expires))
+    })
+    if err != nil {
+        return 0, err
+    }
+    return count, nil
+}
+
+func (b *BoltStorage) Get(key string) (int64, time.Duration, error) {
+    var count int64
+    var ttl time.Duration
+    err := b.db.View(func(tx *bolt.Tx) error {
+        now := b.now()
+        current, expires := decodeCounter(tx.Bucket(boltCounters).Get([]byte(key)))
+        if now.Before(expires) {
+            count, ttl = current, expires.Sub(now)
+        }
+        return nil
+    })
+    return count, ttl, err
+}
+
+func (b *BoltStorage) Touch(key string, ttl time.Duration) error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket(boltCounters)
+        now := b.now()
+        count, expires := decodeCounter(bucket.Get([]byte(key)))
+        if !now.Before(expires) {
+            return nil
+        }
+        return bucket.Put([]byte(key), encodeCounter(count, now.Add(ttl)))
+    })
+}
+
+func (b *BoltStorage) SetBlocked(key string, duration time.Duration) error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket(boltBlocks).Put([]byte(key), encodeExpiry(b.now().Add(duration)))
+    })
+}
+
+func (b *BoltStorage) IsBlocked(key string) (bool, time.Duration, error) {
+    var ttl time.Duration
+    err := b.db.View(func(tx *bolt.Tx) error {
+        now := b.now()
+        if until := decodeExpiry(tx.Bucket(boltBlocks).Get([]byte(key))); now.Before(until) {
+            ttl = until.Sub(now)
+        }
+        return nil
+    })
+    if err != nil {
+        return false, 0, err
+    }
+    return ttl > 0, ttl, nil
+}
+
+// Unblock deletes the block on key.
+func (b *BoltStorage) Unblock(key string) error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket(boltBlocks).Delete([]byte(key))
+    })
+}
+
+// concurrency slots live in a nested bucket per key, lease id -> lease expiry.
+func (b *BoltStorage) Acquire(key string, limit int, lease time.Duration) (string, bool, error) {
+    id, err := newLeaseID()
+    if err != nil {
+        return "", false, err
+    }
+    ok := false
+    err = b.db.Update(func(tx *bolt.Tx) error {
+        slots, err := tx.Bucket(boltConcurrency).CreateBucketIfNotExists([]byte(key))
+        if err != nil {
+            return err
+        }
+        now := b.now()
+        if err := deleteExpired(slots, now); err != nil {
+            return err
+        }
+        if countKeys(slots) >= limit {
+            return nil
+        }
+        ok = true
+        return slots.Put([]byte(id), encodeExpiry(now.Add(lease)))
+    })
+    if err != nil {
+        return "", false, err
+    }
+    return id, ok, nil
+}
+
+func (b *BoltStorage) Refresh(key, id string, lease time.Duration) (bool, error) {
+    held := false
+    err := b.db.Update(func(tx *bolt.Tx) error {
+        slots := tx.Bucket(boltConcurrency).Bucket([]byte(key))
+        if slots == nil {
+            return nil
+        }
+        now := b.now()
+        if !now.Before(decodeExpiry(slots.Get([]byte(id)))) {
+            return nil
+        }
+        held = true
+        return slots.Put([]byte(id), encodeExpiry(now.Add(lease)))
+    })
+    return held, err
+}
+
+func (b *BoltStorage) Release(key, id string) error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        slots := tx.Bucket(boltConcurrency).Bucket([]byte(key))
+        if slots == nil {
+            return nil
+        }
+        return slots.Delete([]byte(id))
+    })
+}
+
+// Compact removes expired counters, blocks and concurrency slots.
+func (b *BoltStorage) Compact() error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        now := b.now()
+        counters := tx.Bucket(boltCounters)
+        var stale [][]byte
+        err := counters.ForEach(func(k, v []byte) error {
+            if _, expires := decodeCounter(v); !now.Before(expires) {
+                stale = append(stale, k)
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        for _, k := range stale {
+            if err := counters.Delete(k); err != nil {
+                return err
+            }
+        }
+
+        if err := deleteExpired(tx.Bucket(boltBlocks), now); err != nil {
+            return err
+        }
+
+        concurrency := tx.Bucket(boltConcurrency)
+        var empty [][]byte
+        err = concurrency.ForEachBucket(func(k []byte) error {
+            slots := concurrency.Bucket(k)
+            if err := deleteExpired(slots, now); err != nil {
+                return err
+            }
+            if countKeys(slots) == 0 {
+                empty = append(empty, k)
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        for _, k := range empty {
+            if err := concurrency.DeleteBucket(k); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// deleteExpired removes the entries of bucket whose expiry has passed. Keys are
+// collected first because a bucket must not be modified while iterating it.
+func deleteExpired(bucket *bolt.Bucket, now time.Time) error {
+    var stale [][]byte
+    err := bucket.ForEach(func(k, v []byte) error {
+        if !now.Before(decodeExpiry(v)) {
+            stale = append(stale, k)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for _, k := range stale {
+        if err := bucket.Delete(k); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// countKeys counts the entries of bucket, including changes made in the current
+// transaction (Bucket.Stats only sees committed pages).
+func countKeys(bucket *bolt.Bucket) int {
+    n := 0
+    c := bucket.Cursor()
+    for k, _ := c.First(); k != nil; k, _ = c.Next() {
+        n++
+    }
+    return n
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+    "context"
+    "path/filepath"
+    "testing"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+func TestBolt_SurvivesRestart(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "ratelimit.db")
+    b, err := NewBoltStorage(path, 0)
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    for i := 0; i < 3; i++ {
+        b.Increment("ip:1", time.Minute)
+    }
+    b.IncrementBy("ip:1", 2, time.Minute)
+    b.SetBlocked("ip:2", time.Minute)
+    if err := b.Close(); err != nil {
+        t.Fatalf("close: %v", err)
+    }
+    if err := b.Ping(context.Background()); err == nil {
+        t.Fatalf("expected ping to fail after close")
+    }
+
+    b, err = NewBoltStorage(path, 0)
+    if err != nil {
+        t.Fatalf("reopen: %v", err)
+    }
+    defer b.Close()
+    if c, ttl, _ := b.Get("ip:1"); c != 5 || ttl <= 0 || ttl > time.Minute {
+        t.Fatalf("expected count 5 with ttl after restart, got %d %v", c, ttl)
+    }
+    if blocked, ttl, _ := b.IsBlocked("ip:2"); !blocked || ttl <= 0 {
+        t.Fatalf("expected block to survive restart, got %v %v", blocked, ttl)
+    }
+    if err := b.Unblock("ip:2"); err != nil {
+        t.Fatalf("unblock: %v", err)
+    }
+    if blocked, _, _ := b.IsBlocked("ip:2"); blocked {
+        t.Fatalf("expected unblocked")
+    }
+}
+
+func TestBolt_CompactRemovesExpired(t *testing.T) {
+    b, err := NewBoltStorage(filepath.Join(t.TempDir(), "ratelimit.db"), 0)
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    defer b.Close()
+
+    b.Increment("short", 20*time.Millisecond)
+    b.Increment("long", time.Minute)
+    b.SetBlocked("short", 20*time.Millisecond)
+    b.SetBlocked("long", time.Minute)
+    b.Acquire("short", 1, 20*time.Millisecond)
+    time.Sleep(30 * time.Millisecond)
+
+    if err := b.Compact(); err != nil {
+        t.Fatalf("compact: %v", err)
+    }
+    b.db.View(func(tx *bolt.Tx) error {
+        if n := countKeys(tx.Bucket(boltCounters)); n != 1 {
+            t.Errorf("expected 1 counter left, got %d", n)
+        }
+        if n := countKeys(tx.Bucket(boltBlocks)); n != 1 {
+            t.Errorf("expected 1 block left, got %d", n)
+        }
+        if tx.Bucket(boltConcurrency).Bucket([]byte("short")) != nil {
+            t.Errorf("expected empty concurrency bucket removed")
+        }
+        return nil
+    })
+}
+
+func TestBolt_Semaphore(t *testing.T) {
+    b, err := NewBoltStorage(filepath.Join(t.TempDir(), "ratelimit.db"), 0)
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    defer b.Close()
+
+    id, ok, err := b.Acquire("k", 1, 50*time.Millisecond)
+    if err != nil || !ok {
+        t.Fatalf("expected first slot, got %v %v", ok, err)
+    }
+    if _, ok, _ := b.Acquire("k", 1, 50*time.Millisecond); ok {
+        t.Fatalf("expected limit reached")
+    }
+    if held, _ := b.Refresh("k", id, 50*time.Millisecond); !held {
+        t.Fatalf("expected refresh of a held slot")
+    }
+    b.Release("k", id)
+    if _, ok, _ := b.Acquire("k", 1, 20*time.Millisecond); !ok {
+        t.Fatalf("expected slot after release")
+    }
+    // a holder that never releases loses its slot when the lease expires
+    time.Sleep(30 * time.Millisecond)
+    if _, ok, _ := b.Acquire("k", 1, time.Second); !ok {
+        t.Fatalf("expected expired lease to free the slot")
+    }
+}
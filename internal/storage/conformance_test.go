@@ -0,0 +1,122 @@
+package storage_test
+
+import (
+    "database/sql"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/alicebob/miniredis/v2"
+    "github.com/bradfitz/gomemcache/memcache"
+    "github.com/redis/go-redis/v9"
+    "github.com/redis/go-redis/v9/maintnotifications"
+    _ "modernc.org/sqlite"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+// newMiniredis starts an in-process Redis. miniredis only expires keys when its clock
+// is fast-forwarded, so it is moved along with real time.
+func newMiniredis(t *testing.T) *miniredis.Miniredis {
+    t.Helper()
+    m := miniredis.RunT(t)
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        const tick = 10 * time.Millisecond
+        ticker := time.NewTicker(tick)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                m.FastForward(tick)
+            }
+        }
+    }()
+    t.Cleanup(func() {
+        close(stop)
+        <-done
+    })
+    return m
+}
+
+func newRedis(t *testing.T) *storage.RedisStorage {
+    r := storage.NewUniversalRedisStorage(&redis.UniversalOptions{
+        Addrs: []string{newMiniredis(t).Addr()},
+        // miniredis does not know CLIENT MAINT_NOTIFICATIONS
+        MaintNotificationsConfig: &maintnotifications.Config{Mode: maintnotifications.ModeDisabled},
+    })
+    t.Cleanup(func() { r.Close() })
+    return r
+}
+
+func newBolt(t *testing.T) *storage.BoltStorage {
+    b, err := storage.NewBoltStorage(filepath.Join(t.TempDir(), "ratelimit.db"), 0)
+    if err != nil {
+        t.Fatalf("open bolt: %v", err)
+    }
+    t.Cleanup(func() { b.Close() })
+    return b
+}
+
+func TestConformance_Redis(t *testing.T) {
+    t.Parallel()
+    storagetest.Run(t, func(t *testing.T) storage.Storage { return newRedis(t) })
+}
+
+func TestConformance_RedisWithPrefix(t *testing.T) {
+    t.Parallel()
+    storagetest.Run(t, func(t *testing.T) storage.Storage {
+        r := newRedis(t)
+        r.SetPrefix("checkout:")
+        return r
+    })
+}
+
+func TestConformance_Bolt(t *testing.T) {
+    t.Parallel()
+    storagetest.Run(t, func(t *testing.T) storage.Storage { return newBolt(t) })
+}
+
+func TestConformance_SQLite(t *testing.T) {
+    t.Parallel()
+    storagetest.Run(t, func(t *testing.T) storage.Storage {
+        db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "ratelimit.sqlite")+"?_pragma=busy_timeout(5000)")
+        if err != nil {
+            t.Fatalf("open sqlite: %v", err)
+        }
+        s, err := storage.NewSQLStorage(db, 0)
+        if err != nil {
+            t.Fatalf("new sql storage: %v", err)
+        }
+        t.Cleanup(func() { s.Close() })
+        return s
+    })
+}
+
+func TestConformance_Memcached(t *testing.T) {
+    t.Parallel()
+    storagetest.Run(t, func(t *testing.T) storage.Storage {
+        m := storage.NewMemcachedStorage(memcache.New(storagetest.NewMemcachedServer(t)))
+        t.Cleanup(func() { m.Close() })
+        return m
+    })
+}
+
+func TestConformance_HybridOverRedis(t *testing.T) {
+    t.Parallel()
+    storagetest.Run(t, func(t *testing.T) storage.Storage {
+        h := storage.NewHybridStorage(newRedis(t), 10*time.Millisecond, 0)
+        t.Cleanup(func() { h.Close() })
+        return h
+    })
+}
+
+func TestConformance_BlockCacheOverBolt(t *testing.T) {
+    t.Parallel()
+    storagetest.Run(t, func(t *testing.T) storage.Storage { return storage.NewBlockCache(newBolt(t)) })
+}
@@ -0,0 +1,8 @@
+package storage
+
+import "time"
+
+// SetHybridClock replaces the clock of h, for tests that move time along.
+func SetHybridClock(h *HybridStorage, now func() time.Time) {
+    h.now = now
+}
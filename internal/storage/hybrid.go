@@ -0,0 +1,318 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+)
+
+// HybridStorage is a two-tier Storage in front of a shared backend (usually Redis).
+// Hot counters live in process: the first increment of a window goes to the backend,
+// later ones are counted locally and sent in one IncrementBy per key every flush
+// interval. Block decisions are cached locally until they expire, as in BlockCache.
+//
+// Counts are approximate across instances: an instance does not see the other
+// instances' increments of the last flush interval (at most maxPending per key when
+// set), so a limit can be exceeded by about that much in exchange for answering most
+// calls without a round trip. Increments in the last flush interval of a window are
+// written through; the few still pending when the window ends (a flush was running or
+// failed) are dropped with it rather than charged to the next window.
+type HybridStorage struct {
+    backend       Storage
+    flushInterval time.Duration
+    maxPending    int64
+    now           func() time.Time
+
+    mu       sync.Mutex
+    counters map[string]*hybridCounter
+
+    blocks *BlockCache
+
+    // flushMu serializes flushes so backend results are applied in order.
+    flushMu sync.Mutex
+
+    stop      chan struct{}
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+type hybridCounter struct {
+    base     int64 // count last returned by the backend
+    inflight int64 // local increments being sent
+    pending  int64 // local increments not sent yet
+    window   time.Duration
+    expires  time.Time
+    // loading is closed once the first increment of the window is back from the
+    // backend; nil after that
+    loading chan struct{}
+}
+
+// count is the backend count plus the local increments it does not include yet.
+func (c *hybridCounter) count() int64 {
+    return c.base + c.inflight + c.pending
+}
+
+// NewHybridStorage wraps backend and starts flushing local increments every flushInterval
+// (100ms when not positive). With maxPending > 0 a key is also flushed as soon as that
+// many increments are pending for it. Call Close to stop and flush what is left.
+func NewHybridStorage(backend Storage, flushInterval time.Duration, maxPending int64) *HybridStorage {
+    if flushInterval <= 0 {
+        flushInterval = 100 * time.Millisecond
+    }
+    h := &HybridStorage{
+        backend:       backend,
+        flushInterval: flushInterval,
+        maxPending:    maxPending,
+        now:           time.Now,
+        counters:      make(map[string]*hybridCounter),
+        blocks:        NewBlockCache(backend),
+        stop:          make(chan struct{}),
+        done:          make(chan struct{}),
+    }
+    go h.run()
+    return h
+}
+
+func (h *HybridStorage) run() {
+    defer close(h.done)
+    ticker := time.NewTicker(h.flushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-h.stop:
+            return
+        case <-ticker.C:
+            _ = h.Flush()
+        }
+    }
+}
+
+// Close stops the background flusher and sends the pending increments to the backend.
+// It does not close the backend.
+func (h *HybridStorage) Close() error {
+    h.closeOnce.Do(func() { close(h.stop) })
+    <-h.done
+    return h.Flush()
+}
+
+func (h *HybridStorage) Increment(key string, window time.Duration) (int64, error) {
+    return h.IncrementBy(key, 1, window)
+}
+
+func (h *HybridStorage) IncrementBy(key string, n int64, window time.Duration) (int64, error) {
+    for {
+        now := h.now()
+        h.mu.Lock()
+        c, ok := h.counters[key]
+        if ok && c.loading != nil {
+            // the window's count is on its way from the backend; counting from zero
+            // meanwhile would ignore what other instances already counted
+            loading := c.loading
+            h.mu.Unlock()
+            <-loading
+            continue
+        }
+        if ok && now.Before(c.expires) {
+            if count := c.count(); count+n < 0 {
+                // counters stop at zero
+                n = -count
+            }
+            c.pending += n
+            count := c.count()
+            full := h.maxPending > 0 && (c.pending >= h.maxPending || -c.pending >= h.maxPending)
+            // write through near the end of the window so little is pending when it ends
+            ending := c.expires.Sub(now) <= h.flushInterval
+            h.mu.Unlock()
+            if (full || ending) && h.flushMu.TryLock() {
+                // a running flush will pick the key up otherwise
+                _ = h.flushKey(key)
+                h.flushMu.Unlock()
+            }
+            return count, nil
+        }
+
+        if n < 0 {
+            // a decrement starts no window; another instance may still have one
+            h.mu.Unlock()
+            return h.backend.IncrementBy(key, n, window)
+        }
+        // first increment of the window: go to the backend so the count starts exact
+        c = &hybridCounter{window: window, expires: now.Add(window), loading: make(chan struct{})}
+        h.counters[key] = c
+        h.mu.Unlock()
+        return h.load(key, c, n, now)
+    }
+}
+
+// load sends the first increment of a window to the backend and fills c with the
+// result. Calls for the same key wait for it.
+func (h *HybridStorage) load(key string, c *hybridCounter, n int64, now time.Time) (int64, error) {
+    count, err := h.backend.IncrementBy(key, n, c.window)
+    var ttl time.Duration
+    if err == nil && count != n {
+        // the key already existed, so its window started earlier
+        if _, left, err := h.backend.Get(key); err == nil {
+            ttl = left
+        }
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    close(c.loading)
+    c.loading = nil
+    if err != nil {
+        // nothing was counted; the waiting calls go to the backend themselves
+        if h.counters[key] == c {
+            delete(h.counters, key)
+        }
+        return 0, err
+    }
+    c.base = count
+    if ttl > 0 {
+        c.expires = now.Add(ttl)
+    }
+    return count, nil
+}
+
+func (h *HybridStorage) Get(key string) (int64, time.Duration, error) {
+    now := h.now()
+    h.mu.Lock()
+    if c, ok := h.counters[key]; ok && c.loading == nil && now.Before(c.expires) {
+        count, ttl := c.count(), c.expires.Sub(now)
+        h.mu.Unlock()
+        return count, ttl, nil
+    }
+    h.mu.Unlock()
+    return h.backend.Get(key)
+}
+
+// Touch moves the expiry in the backend, and of the local counter with it.
+func (h *HybridStorage) Touch(key string, ttl time.Duration) error {
+    t, ok := h.backend.(Toucher)
+    if !ok {
+        return ErrTouchUnsupported
+    }
+    if err := t.Touch(key, ttl); err != nil {
+        return err
+    }
+    now := h.now()
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if c, ok := h.counters[key]; ok && c.loading == nil && now.Before(c.expires) {
+        c.expires = now.Add(ttl)
+    }
+    return nil
+}
+
+func (h *HybridStorage) SetBlocked(key string, duration time.Duration) error {
+    return h.blocks.SetBlocked(key, duration)
+}
+
+func (h *HybridStorage) IsBlocked(key string) (bool, time.Duration, error) {
+    return h.blocks.IsBlocked(key)
+}
+
+// Unblock lifts the block in the backend and drops it from the local cache.
+func (h *HybridStorage) Unblock(key string) error {
+    return h.blocks.Unblock(key)
+}
+
+// Watch drops blocks lifted by other instances from the local cache, see BlockCache.Watch.
+func (h *HybridStorage) Watch(ctx context.Context) error {
+    return h.blocks.Watch(ctx)
+}
+
+// Ping checks the backend.
+func (h *HybridStorage) Ping(ctx context.Context) error {
+    return h.backend.Ping(ctx)
+}
+
+// Flush sends the pending increments of every key to the backend and drops expired
+// entries. It runs every flush interval; calling it directly is only needed in tests.
+func (h *HybridStorage) Flush() error {
+    h.flushMu.Lock()
+    defer h.flushMu.Unlock()
+
+    now := h.now()
+    var keys []string
+    h.mu.Lock()
+    for key, c := range h.counters {
+        if c.loading != nil {
+            continue
+        }
+        if !now.Before(c.expires) {
+            // the window has ended: sending its increments now would charge them to
+            // the next one
+            delete(h.counters, key)
+        } else if c.pending != 0 {
+            keys = append(keys, key)
+        }
+    }
+    h.mu.Unlock()
+
+    var errs []error
+    for _, key := range keys {
+        if err := h.flushKey(key); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// flushKey sends the pending increments of key. Callers must hold flushMu.
+func (h *HybridStorage) flushKey(key string) error {
+    h.mu.Lock()
+    c, ok := h.counters[key]
+    if !ok || c.pending == 0 || !h.now().Before(c.expires) {
+        h.mu.Unlock()
+        return nil
+    }
+    delta, window := c.pending, c.window
+    c.inflight += delta
+    c.pending = 0
+    h.mu.Unlock()
+
+    count, err := h.backend.IncrementBy(key, delta, window)
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    c.inflight -= delta
+    if err != nil {
+        // keep the increments for the next flush
+        c.pending += delta
+        return err
+    }
+    c.base = count
+    if count == delta {
+        // the backend window ended and our flush started a new one
+        c.expires = h.now().Add(window)
+    }
+    return nil
+}
+
+// Acquire, Refresh and Release go straight to the backend: in-flight slots cannot be
+// approximated locally.
+func (h *HybridStorage) Acquire(key string, limit int, lease time.Duration) (string, bool, error) {
+    sem, ok := h.backend.(Semaphore)
+    if !ok {
+        return "", false, ErrSemaphoreUnsupported
+    }
+    return sem.Acquire(key, limit, lease)
+}
+
+func (h *HybridStorage) Refresh(key, id string, lease time.Duration) (bool, error) {
+    sem, ok := h.backend.(Semaphore)
+    if !ok {
+        return false, ErrSemaphoreUnsupported
+    }
+    return sem.Refresh(key, id, lease)
+}
+
+func (h *HybridStorage) Release(key, id string) error {
+    sem, ok := h.backend.(Semaphore)
+    if !ok {
+        return ErrSemaphoreUnsupported
+    }
+    return sem.Release(key, id)
+}
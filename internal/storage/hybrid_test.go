@@ -0,0 +1,216 @@
+package storage_test
+
+import (
+    "errors"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func TestHybrid_BatchesIncrements(t *testing.T) {
+    backend := storagetest.NewMemory()
+    h := storage.NewHybridStorage(backend, time.Minute, 0)
+    defer h.Close()
+
+    for i := int64(1); i <= 10; i++ {
+        c, err := h.Increment("ip:1", time.Hour)
+        if err != nil || c != i {
+            t.Fatalf("increment %d: got %d %v", i, c, err)
+        }
+    }
+    if calls := backend.Calls(); calls != 1 {
+        t.Fatalf("expected only the first increment to reach the backend, got %d calls", calls)
+    }
+    if c, ttl, _ := h.Get("ip:1"); c != 10 || ttl <= 0 {
+        t.Fatalf("expected local count 10 with ttl, got %d %v", c, ttl)
+    }
+
+    // another instance adds to the shared counter; the flush brings it in
+    backend.IncrementBy("ip:1", 5, time.Hour)
+    if err := h.Flush(); err != nil {
+        t.Fatalf("flush: %v", err)
+    }
+    if c, _, _ := backend.Get("ip:1"); c != 15 {
+        t.Fatalf("expected backend count 15 after flush, got %d", c)
+    }
+    if c, _ := h.Increment("ip:1", time.Hour); c != 16 {
+        t.Fatalf("expected 16 after flush, got %d", c)
+    }
+}
+
+func TestHybrid_MaxPendingFlushesEarly(t *testing.T) {
+    backend := storagetest.NewMemory()
+    h := storage.NewHybridStorage(backend, time.Minute, 3)
+    defer h.Close()
+
+    for i := 0; i < 4; i++ {
+        h.Increment("k", time.Hour)
+    }
+    if c, _, _ := backend.Get("k"); c != 4 {
+        t.Fatalf("expected pending increments flushed at maxPending, backend has %d", c)
+    }
+}
+
+func TestHybrid_FlushErrorKeepsIncrements(t *testing.T) {
+    backend := storagetest.NewMemory()
+    h := storage.NewHybridStorage(backend, time.Minute, 0)
+    defer h.Close()
+
+    h.Increment("k", time.Hour)
+    h.IncrementBy("k", 2, time.Hour)
+    backend.FailIncrements(errors.New("backend down"))
+    if err := h.Flush(); err == nil {
+        t.Fatalf("expected flush error")
+    }
+    backend.FailIncrements(nil)
+    if err := h.Close(); err != nil {
+        t.Fatalf("close: %v", err)
+    }
+    if c, _, _ := backend.Get("k"); c != 3 {
+        t.Fatalf("expected increments kept across a failed flush, got %d", c)
+    }
+}
+
+func TestHybrid_CachesBlocks(t *testing.T) {
+    backend := storagetest.NewMemory()
+    h := storage.NewHybridStorage(backend, time.Hour, 0)
+    defer h.Close()
+
+    if blocked, _, _ := h.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected not blocked")
+    }
+    // blocked by another instance: seen on the next lookup, then served locally
+    backend.SetBlocked("ip:1", time.Minute)
+    before := backend.Calls()
+    for i := 0; i < 5; i++ {
+        blocked, ttl, err := h.IsBlocked("ip:1")
+        if err != nil || !blocked || ttl <= 0 {
+            t.Fatalf("expected blocked, got %v %v %v", blocked, ttl, err)
+        }
+    }
+    if calls := backend.Calls() - before; calls != 1 {
+        t.Fatalf("expected one backend lookup for a blocked key, got %d", calls)
+    }
+
+    if err := h.SetBlocked("ip:2", 50*time.Millisecond); err != nil {
+        t.Fatalf("set blocked: %v", err)
+    }
+    before = backend.Calls()
+    if blocked, _, _ := h.IsBlocked("ip:2"); !blocked || backend.Calls() != before {
+        t.Fatalf("expected local block decision without a backend call")
+    }
+    time.Sleep(60 * time.Millisecond)
+    if blocked, _, _ := h.IsBlocked("ip:2"); blocked {
+        t.Fatalf("expected block to expire")
+    }
+}
+
+func TestHybrid_SemaphoreUnsupported(t *testing.T) {
+    // embedding hides Memory's semaphore
+    h := storage.NewHybridStorage(struct{ storage.Storage }{storagetest.NewMemory()}, time.Hour, 0)
+    defer h.Close()
+    if _, _, err := h.Acquire("k", 1, time.Second); !errors.Is(err, storage.ErrSemaphoreUnsupported) {
+        t.Fatalf("expected storage.ErrSemaphoreUnsupported, got %v", err)
+    }
+}
+
+// the first increment of a window waits for the backend; concurrent calls must
+// count behind it, not from zero
+func TestHybrid_ConcurrentFirstIncrementsSeeBackendCount(t *testing.T) {
+    backend := storagetest.NewMemory()
+    backend.IncrementBy("k", 100, time.Hour) // counted by another instance
+    backend.SlowIncrements(20 * time.Millisecond)
+    h := storage.NewHybridStorage(backend, time.Minute, 3)
+    defer h.Close()
+
+    var mu sync.Mutex
+    seen := make(map[int64]bool)
+    var wg sync.WaitGroup
+    for w := 0; w < 8; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 5; i++ {
+                c, err := h.Increment("k", time.Hour)
+                mu.Lock()
+                if err != nil || c <= 100 || seen[c] {
+                    t.Errorf("expected a distinct count above 100, got %d %v", c, err)
+                }
+                seen[c] = true
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    h.Flush()
+    if c, _, _ := backend.Get("k"); c != 140 {
+        t.Fatalf("expected 140 in the backend, got %d", c)
+    }
+}
+
+func TestHybrid_FailedFirstIncrementIsNotCached(t *testing.T) {
+    backend := storagetest.NewMemory()
+    h := storage.NewHybridStorage(backend, time.Minute, 0)
+    defer h.Close()
+
+    backend.FailIncrements(errors.New("backend down"))
+    if _, err := h.Increment("k", time.Hour); err == nil {
+        t.Fatalf("expected the backend error")
+    }
+    backend.FailIncrements(nil)
+    if c, err := h.Increment("k", time.Hour); err != nil || c != 1 {
+        t.Fatalf("expected the next increment to start the window, got %d %v", c, err)
+    }
+}
+
+func TestHybrid_ExpiredWindowIsNotChargedToNext(t *testing.T) {
+    backend := storagetest.NewMemory()
+    h := storage.NewHybridStorage(backend, time.Minute, 0)
+    defer h.Close()
+    now := time.Now()
+    storage.SetHybridClock(h, func() time.Time { return now })
+
+    h.Increment("flushed", time.Hour)
+    h.IncrementBy("flushed", 2, time.Hour)
+    h.Increment("replaced", time.Hour)
+    h.IncrementBy("replaced", 2, time.Hour)
+    // the local windows end; the backend ones have not in this test, so anything
+    // sent now would show up there
+    now = now.Add(time.Hour + time.Second)
+
+    if err := h.Flush(); err != nil {
+        t.Fatalf("flush: %v", err)
+    }
+    if c, _, _ := backend.Get("flushed"); c != 1 {
+        t.Fatalf("expected the ended window's increments dropped, backend has %d", c)
+    }
+    h.Increment("replaced", time.Hour)
+    h.Flush()
+    if c, _, _ := backend.Get("replaced"); c != 2 {
+        t.Fatalf("expected only the new window's increment sent, backend has %d", c)
+    }
+}
+
+func TestHybrid_WritesThroughNearWindowEnd(t *testing.T) {
+    backend := storagetest.NewMemory()
+    h := storage.NewHybridStorage(backend, time.Minute, 0)
+    defer h.Close()
+    now := time.Now()
+    storage.SetHybridClock(h, func() time.Time { return now })
+
+    h.Increment("k", time.Hour)
+    h.Increment("k", time.Hour)
+    if c, _, _ := backend.Get("k"); c != 1 {
+        t.Fatalf("expected the second increment kept locally, backend has %d", c)
+    }
+    now = now.Add(time.Hour - 30*time.Second)
+    if c, _ := h.Increment("k", time.Hour); c != 3 {
+        t.Fatalf("expected 3, got %d", c)
+    }
+    if c, _, _ := backend.Get("k"); c != 3 {
+        t.Fatalf("expected increments written through in the last flush interval, backend has %d", c)
+    }
+}
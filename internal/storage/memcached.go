@@ -0,0 +1,200 @@
+package storage
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/bradfitz/gomemcache/memcache"
+)
+
+// maxRelativeExpiration is the longest expiration memcached reads as seconds from now;
+// larger values are taken as unix timestamps.
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+// MemcachedStorage keeps counters and blocks in memcached. Counters are created with
+// add and updated with incr/decr, so increments from several instances are atomic.
+//
+// memcached cannot report an item's TTL, so every item carries its expiry (unix
+// seconds) in the client flags, which incr/decr leave untouched. Expirations have
+// second granularity: windows and blocks are rounded up to whole seconds. Counters
+// cannot go below zero (decr stops at 0).
+type MemcachedStorage struct {
+    client *memcache.Client
+    now    func() time.Time
+}
+
+// NewMemcachedStorage creates a MemcachedStorage using client, e.g.
+// memcache.New("10.0.0.1:11211", "10.0.0.2:11211").
+func NewMemcachedStorage(client *memcache.Client) *MemcachedStorage {
+    return &MemcachedStorage{client: client, now: time.Now}
+}
+
+// memcachedKey returns key if memcached accepts it (at most 250 bytes, no spaces or
+// control characters) and a hash of it otherwise.
+func memcachedKey(key string) string {
+    legal := len(key) <= 250
+    for i := 0; legal && i < len(key); i++ {
+        legal = key[i] > ' ' && key[i] != 0x7f
+    }
+    if legal {
+        return key
+    }
+    sum := sha256.Sum256([]byte(key))
+    return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (m *MemcachedStorage) counterKey(key string) string {
+    return memcachedKey(key)
+}
+
+func (m *MemcachedStorage) blockedKey(key string) string {
+    return memcachedKey("blocked:" + key)
+}
+
+// expiry returns the unix time d from now, rounded up to a whole second, and the
+// matching memcached expiration. The reported TTL may thus end up to a second before
+// memcached drops the item, never after.
+func (m *MemcachedStorage) expiry(d time.Duration) (uint32, int32) {
+    secs := int64((d + time.Second - 1) / time.Second)
+    if secs < 1 {
+        secs = 1
+    }
+    until := m.now().Unix() + secs
+    if secs > maxRelativeExpiration {
+        return uint32(until), int32(until)
+    }
+    return uint32(until), int32(secs)
+}
+
+// remaining is the time left until the expiry kept in an item's flags.
+func (m *MemcachedStorage) remaining(it *memcache.Item) time.Duration {
+    ttl := time.Unix(int64(it.Flags), 0).Sub(m.now())
+    if ttl < 0 {
+        return 0
+    }
+    return ttl
+}
+
+// Ping asks every server for its version.
+func (m *MemcachedStorage) Ping(ctx context.Context) error {
+    return m.client.Ping()
+}
+
+// Close closes the idle connections.
+func (m *MemcachedStorage) Close() error {
+    return m.client.Close()
+}
+
+func (m *MemcachedStorage) Increment(key string, window time.Duration) (int64, error) {
+    return m.IncrementBy(key, 1, window)
+}
+
+func (m *MemcachedStorage) IncrementBy(key string, n int64, window time.Duration) (int64, error) {
+    ckey := m.counterKey(key)
+    // a miss is followed by add; if another instance adds first, incr again
+    for attempt := 0; attempt < 3; attempt++ {
+        var v uint64
+        var err error
+        if n >= 0 {
+            v, err = m.client.Increment(ckey, uint64(n))
+        } else {
+            v, err = m.client.Decrement(ckey, uint64(-n))
+        }
+        if err == nil {
+            return int64(v), nil
+        }
+        if !errors.Is(err, memcache.ErrCacheMiss) {
+            return 0, err
+        }
+        if n < 0 {
+            // nothing to take from: no window starts
+            return 0, nil
+        }
+
+        flags, exp := m.expiry(window)
+        err = m.client.Add(&memcache.Item{Key: ckey, Value: []byte(strconv.FormatInt(n, 10)), Flags: flags, Expiration: exp})
+        if err == nil {
+            return n, nil
+        }
+        if !errors.Is(err, memcache.ErrNotStored) {
+            return 0, err
+        }
+    }
+    return 0, errors.New("storage: memcached counter kept disappearing")
+}
+
+func (m *MemcachedStorage) Get(key string) (int64, time.Duration, error) {
+    it, err := m.client.Get(m.counterKey(key))
+    if errors.Is(err, memcache.ErrCacheMiss) {
+        return 0, 0, nil
+    }
+    if err != nil {
+        return 0, 0, err
+    }
+    // decr may leave trailing spaces where digits were
+    count, err := strconv.ParseInt(strings.TrimSpace(string(it.Value)), 10, 64)
+    if err != nil {
+        return 0, 0, err
+    }
+    return count, m.remaining(it), nil
+}
+
+// Touch rewrites the counter with the new expiry in its flags too, through CAS so a
+// concurrent increment is not lost.
+func (m *MemcachedStorage) Touch(key string, ttl time.Duration) error {
+    ckey := m.counterKey(key)
+    for attempt := 0; attempt < 3; attempt++ {
+        it, err := m.client.Get(ckey)
+        if errors.Is(err, memcache.ErrCacheMiss) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        it.Flags, it.Expiration = m.expiry(ttl)
+        err = m.client.CompareAndSwap(it)
+        if err == nil || errors.Is(err, memcache.ErrCacheMiss) || errors.Is(err, memcache.ErrNotStored) {
+            // written, or gone since the get
+            return nil
+        }
+        if !errors.Is(err, memcache.ErrCASConflict) {
+            return err
+        }
+    }
+    return errors.New("storage: memcached counter kept changing")
+}
+
+func (m *MemcachedStorage) SetBlocked(key string, duration time.Duration) error {
+    if duration <= 0 {
+        // rounding up would block for a second; a non-positive block blocks nothing
+        return m.Unblock(key)
+    }
+    flags, exp := m.expiry(duration)
+    return m.client.Set(&memcache.Item{Key: m.blockedKey(key), Value: []byte("1"), Flags: flags, Expiration: exp})
+}
+
+func (m *MemcachedStorage) IsBlocked(key string) (bool, time.Duration, error) {
+    it, err := m.client.Get(m.blockedKey(key))
+    if errors.Is(err, memcache.ErrCacheMiss) {
+        return false, 0, nil
+    }
+    if err != nil {
+        return false, 0, err
+    }
+    ttl := m.remaining(it)
+    return ttl > 0, ttl, nil
+}
+
+// Unblock deletes the block on key.
+func (m *MemcachedStorage) Unblock(key string) error {
+    err := m.client.Delete(m.blockedKey(key))
+    if errors.Is(err, memcache.ErrCacheMiss) {
+        return nil
+    }
+    return err
+}
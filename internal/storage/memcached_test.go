@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/bradfitz/gomemcache/memcache"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func newTestMemcachedStorage(t *testing.T) *storage.MemcachedStorage {
+    t.Helper()
+    m := storage.NewMemcachedStorage(memcache.New(storagetest.NewMemcachedServer(t)))
+    t.Cleanup(func() { m.Close() })
+    return m
+}
+
+func TestMemcached_BlocksAndIllegalKeys(t *testing.T) {
+    m := newTestMemcachedStorage(t)
+    // scopes and tokens may contain spaces or be longer than memcached allows
+    key := "route:GET /orders|token:" + strings.Repeat("x", 300)
+    if c, err := m.Increment(key, time.Minute); err != nil || c != 1 {
+        t.Fatalf("expected hashed key to work, got %d %v", c, err)
+    }
+
+    if err := m.SetBlocked(key, time.Minute); err != nil {
+        t.Fatalf("set blocked: %v", err)
+    }
+    if blocked, ttl, _ := m.IsBlocked(key); !blocked || ttl <= 0 || ttl > time.Minute {
+        t.Fatalf("expected blocked, got %v %v", blocked, ttl)
+    }
+    if err := m.Unblock(key); err != nil {
+        t.Fatalf("unblock: %v", err)
+    }
+    if blocked, _, _ := m.IsBlocked(key); blocked {
+        t.Fatalf("expected unblocked")
+    }
+    if err := m.Unblock(key); err != nil {
+        t.Fatalf("unblocking twice should not fail: %v", err)
+    }
+}
+
+func TestMemcached_CountersStopAtZero(t *testing.T) {
+    m := newTestMemcachedStorage(t)
+    m.IncrementBy("k", 2, time.Minute)
+    if c, err := m.IncrementBy("k", -5, time.Minute); err != nil || c != 0 {
+        t.Fatalf("expected decr to stop at 0, got %d %v", c, err)
+    }
+    if c, err := m.IncrementBy("new", -1, time.Minute); err != nil || c != 0 {
+        t.Fatalf("expected a negative first increment to start at 0, got %d %v", c, err)
+    }
+}
@@ -2,13 +2,22 @@ package storage
 
 import (
     "context"
+    "crypto/rand"
+    "encoding/hex"
     "time"
 
     "github.com/redis/go-redis/v9"
 )
 
 type RedisStorage struct {
-    client *redis.Client
+    client redis.UniversalClient
+
+    // hashTags wraps keys in {} so a counter and its blocked:/concurrency: keys
+    // hash to the same cluster slot and can be used together in scripts.
+    hashTags bool
+
+    // prefix namespaces every key, so several services can share one Redis.
+    prefix string
 }
 
 // NewRedisStorage creates a new RedisStorage.
@@ -21,6 +30,51 @@ func NewRedisStorage(addr, password string, db int) *RedisStorage {
     return &RedisStorage{client: rdb}
 }
 
+// NewUniversalRedisStorage creates a RedisStorage for a single node, a Sentinel-managed
+// master (opts.MasterName) or a Cluster (several opts.Addrs or opts.IsClusterMode), as
+// chosen by redis.NewUniversalClient. Hash tags are enabled for Cluster.
+func NewUniversalRedisStorage(opts *redis.UniversalOptions) *RedisStorage {
+    rdb := redis.NewUniversalClient(opts)
+    _, cluster := rdb.(*redis.ClusterClient)
+    return &RedisStorage{client: rdb, hashTags: cluster}
+}
+
+// SetPrefix sets the namespace prepended to every key (e.g. "checkout:").
+func (r *RedisStorage) SetPrefix(prefix string) {
+    r.prefix = prefix
+}
+
+// tagged wraps key in a hash tag when enabled, so a counter and its blocked: and
+// concurrency: keys share a hash slot.
+func (r *RedisStorage) tagged(key string) string {
+    if r.hashTags {
+        return "{" + key + "}"
+    }
+    return key
+}
+
+func (r *RedisStorage) counterKey(key string) string {
+    return r.prefix + r.tagged(key)
+}
+
+func (r *RedisStorage) blockedKey(key string) string {
+    return r.prefix + "blocked:" + r.tagged(key)
+}
+
+func (r *RedisStorage) concurrencyKey(key string) string {
+    return r.prefix + "concurrency:" + r.tagged(key)
+}
+
+// Ping sends a PING to Redis.
+func (r *RedisStorage) Ping(ctx context.Context) error {
+    return r.client.Ping(ctx).Err()
+}
+
+// Close closes the underlying Redis client.
+func (r *RedisStorage) Close() error {
+    return r.client.Close()
+}
+
 var incrScript = redis.NewScript(`
 local current = redis.call("INCR", KEYS[1])
 if tonumber(current) == 1 then
@@ -32,7 +86,7 @@ return current
 func (r *RedisStorage) Increment(key string, window time.Duration) (int64, error) {
     ctx := context.Background()
     seconds := int(window.Seconds())
-    res, err := incrScript.Run(ctx, r.client, []string{key}, seconds).Result()
+    res, err := incrScript.Run(ctx, r.client, []string{r.counterKey(key)}, seconds).Result()
     if err != nil {
         return 0, err
     }
@@ -49,15 +103,67 @@ func (r *RedisStorage) Increment(key string, window time.Duration) (int64, error
     }
 }
 
+// incrByScript adds ARGV[2] to the counter, starting its window of ARGV[1] ms. A
+// decrement only applies to an existing counter and stops at zero.
+var incrByScript = redis.NewScript(`
+local n = tonumber(ARGV[2])
+if n < 0 then
+  local existing = redis.call("GET", KEYS[1])
+  if not existing then
+    return 0
+  end
+  if tonumber(existing) + n < 0 then
+    n = -tonumber(existing)
+  end
+end
+local current = redis.call("INCRBY", KEYS[1], n)
+if redis.call("PTTL", KEYS[1]) == -1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return current
+`)
+
+func (r *RedisStorage) IncrementBy(key string, n int64, window time.Duration) (int64, error) {
+    ctx := context.Background()
+    return incrByScript.Run(ctx, r.client, []string{r.counterKey(key)}, window.Milliseconds(), n).Int64()
+}
+
+func (r *RedisStorage) Get(key string) (int64, time.Duration, error) {
+    ctx := context.Background()
+    ckey := r.counterKey(key)
+    pipe := r.client.Pipeline()
+    get := pipe.Get(ctx, ckey)
+    pttl := pipe.PTTL(ctx, ckey)
+    if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+        return 0, 0, err
+    }
+    cnt, err := get.Int64()
+    if err == redis.Nil {
+        return 0, 0, nil
+    }
+    if err != nil {
+        return 0, 0, err
+    }
+    ttl := pttl.Val()
+    if ttl < 0 {
+        ttl = 0
+    }
+    return cnt, ttl, nil
+}
+
+func (r *RedisStorage) Touch(key string, ttl time.Duration) error {
+    return r.client.PExpire(context.Background(), r.counterKey(key), ttl).Err()
+}
+
 func (r *RedisStorage) SetBlocked(key string, duration time.Duration) error {
     ctx := context.Background()
-    bkey := "blocked:" + key
+    bkey := r.blockedKey(key)
     return r.client.Set(ctx, bkey, "1", duration).Err()
 }
 
 func (r *RedisStorage) IsBlocked(key string) (bool, time.Duration, error) {
     ctx := context.Background()
-    bkey := "blocked:" + key
+    bkey := r.blockedKey(key)
     ttl, err := r.client.TTL(ctx, bkey).Result()
     if err != nil {
         // if key doesn't exist, Redis returns -2
@@ -68,3 +174,102 @@ func (r *RedisStorage) IsBlocked(key string) (bool, time.Duration, error) {
     }
     return true, ttl, nil
 }
+
+// Unblock deletes the block on key and announces it on the unblock channel.
+func (r *RedisStorage) Unblock(key string) error {
+    ctx := context.Background()
+    if err := r.client.Del(ctx, r.blockedKey(key)).Err(); err != nil {
+        return err
+    }
+    return r.client.Publish(ctx, r.unblockChannel(), key).Err()
+}
+
+// WatchUnblocks subscribes to the unblock channel and calls fn for every message until
+// ctx is done. Unblocks published while the connection is down are missed.
+func (r *RedisStorage) WatchUnblocks(ctx context.Context, fn func(key string)) error {
+    sub := r.client.Subscribe(ctx, r.unblockChannel())
+    defer sub.Close()
+    // wait for the subscription to be confirmed, so setup errors are reported
+    if _, err := sub.Receive(ctx); err != nil {
+        return err
+    }
+    ch := sub.Channel()
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case msg, ok := <-ch:
+            if !ok {
+                return nil
+            }
+            fn(msg.Payload)
+        }
+    }
+}
+
+func (r *RedisStorage) unblockChannel() string {
+    return r.prefix + "unblock"
+}
+
+// semaphore slots live in a sorted set scored by lease expiry (Redis server time, so
+// instances with skewed clocks agree); expired members are purged on every acquire.
+var acquireScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[1]) then
+  return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+var refreshScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local score = redis.call("ZSCORE", KEYS[1], ARGV[2])
+if not score or tonumber(score) <= now then
+  return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[1]), ARGV[2])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[1]) then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+func (r *RedisStorage) Acquire(key string, limit int, lease time.Duration) (string, bool, error) {
+    ctx := context.Background()
+    id, err := newLeaseID()
+    if err != nil {
+        return "", false, err
+    }
+    ok, err := acquireScript.Run(ctx, r.client, []string{r.concurrencyKey(key)}, limit, lease.Milliseconds(), id).Int()
+    if err != nil {
+        return "", false, err
+    }
+    return id, ok == 1, nil
+}
+
+func (r *RedisStorage) Refresh(key, id string, lease time.Duration) (bool, error) {
+    ctx := context.Background()
+    ok, err := refreshScript.Run(ctx, r.client, []string{r.concurrencyKey(key)}, lease.Milliseconds(), id).Int()
+    if err != nil {
+        return false, err
+    }
+    return ok == 1, nil
+}
+
+func (r *RedisStorage) Release(key, id string) error {
+    ctx := context.Background()
+    return r.client.ZRem(ctx, r.concurrencyKey(key), id).Err()
+}
+
+func newLeaseID() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// RedisConfig describes how to connect to Redis. Zero values keep go-redis defaults.
+type RedisConfig struct {
+    // Mode is "single" (default), "cluster" or "sentinel".
+    Mode string
+    // URL is a redis:// or rediss:// URL (user, password, host, db and query options).
+    // Fields set explicitly below take precedence over the URL.
+    URL string
+
+    // KeyPrefix namespaces every key (e.g. "checkout:").
+    KeyPrefix string
+
+    Addrs            []string
+    Username         string
+    Password         string
+    // DB selects the database; nil keeps the URL's (or 0), so an explicit 0 still
+    // overrides a URL pointing elsewhere.
+    DB               *int
+    MasterName       string
+    SentinelPassword string
+
+    TLS                   bool
+    TLSCAFile             string
+    TLSCertFile           string
+    TLSKeyFile            string
+    TLSServerName         string
+    TLSInsecureSkipVerify bool
+
+    PoolSize     int
+    MinIdleConns int
+    DialTimeout  time.Duration
+    ReadTimeout  time.Duration
+    WriteTimeout time.Duration
+}
+
+// NewRedisStorageFromConfig builds a RedisStorage for cfg.
+func NewRedisStorageFromConfig(cfg RedisConfig) (*RedisStorage, error) {
+    opts, err := cfg.UniversalOptions()
+    if err != nil {
+        return nil, err
+    }
+    r := NewUniversalRedisStorage(opts)
+    r.SetPrefix(cfg.KeyPrefix)
+    return r, nil
+}
+
+// UniversalOptions converts cfg into go-redis options.
+func (cfg RedisConfig) UniversalOptions() (*redis.UniversalOptions, error) {
+    opts := &redis.UniversalOptions{}
+    if cfg.URL != "" {
+        if err := applyURL(opts, cfg.Mode, cfg.URL); err != nil {
+            return nil, err
+        }
+    }
+
+    if len(cfg.Addrs) > 0 {
+        opts.Addrs = cfg.Addrs
+    }
+    if len(opts.Addrs) == 0 {
+        opts.Addrs = []string{"localhost:6379"}
+    }
+    if cfg.Username != "" {
+        opts.Username = cfg.Username
+    }
+    if cfg.Password != "" {
+        opts.Password = cfg.Password
+    }
+    if cfg.DB != nil {
+        opts.DB = *cfg.DB
+    }
+    if cfg.PoolSize > 0 {
+        opts.PoolSize = cfg.PoolSize
+    }
+    if cfg.MinIdleConns > 0 {
+        opts.MinIdleConns = cfg.MinIdleConns
+    }
+    if cfg.DialTimeout > 0 {
+        opts.DialTimeout = cfg.DialTimeout
+    }
+    if cfg.ReadTimeout > 0 {
+        opts.ReadTimeout = cfg.ReadTimeout
+    }
+    if cfg.WriteTimeout > 0 {
+        opts.WriteTimeout = cfg.WriteTimeout
+    }
+
+    if cfg.TLS || cfg.TLSCAFile != "" || cfg.TLSCertFile != "" || cfg.TLSServerName != "" || cfg.TLSInsecureSkipVerify {
+        tc, err := cfg.tlsConfig(opts.TLSConfig)
+        if err != nil {
+            return nil, err
+        }
+        opts.TLSConfig = tc
+    }
+
+    switch cfg.Mode {
+    case "cluster":
+        opts.IsClusterMode = true
+    case "sentinel":
+        opts.MasterName = cfg.MasterName
+        if opts.MasterName == "" {
+            opts.MasterName = "mymaster"
+        }
+        opts.SentinelPassword = cfg.SentinelPassword
+    case "", "single":
+        opts.Addrs = opts.Addrs[:1]
+    default:
+        return nil, fmt.Errorf("redis: unknown mode %q", cfg.Mode)
+    }
+    return opts, nil
+}
+
+// applyURL fills opts from a redis:// or rediss:// URL.
+func applyURL(opts *redis.UniversalOptions, mode, rawURL string) error {
+    if mode == "cluster" {
+        co, err := redis.ParseClusterURL(rawURL)
+        if err != nil {
+            return fmt.Errorf("redis: parse url: %w", err)
+        }
+        opts.Addrs = co.Addrs
+        opts.Username, opts.Password = co.Username, co.Password
+        opts.TLSConfig = co.TLSConfig
+        opts.PoolSize, opts.MinIdleConns = co.PoolSize, co.MinIdleConns
+        opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = co.DialTimeout, co.ReadTimeout, co.WriteTimeout
+        return nil
+    }
+    o, err := redis.ParseURL(rawURL)
+    if err != nil {
+        return fmt.Errorf("redis: parse url: %w", err)
+    }
+    opts.Addrs = []string{o.Addr}
+    opts.Username, opts.Password, opts.DB = o.Username, o.Password, o.DB
+    opts.TLSConfig = o.TLSConfig
+    opts.PoolSize, opts.MinIdleConns = o.PoolSize, o.MinIdleConns
+    opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = o.DialTimeout, o.ReadTimeout, o.WriteTimeout
+    return nil
+}
+
+// tlsConfig extends base (from a rediss:// URL, may be nil) with the configured CA,
+// client certificate and server name.
+func (cfg RedisConfig) tlsConfig(base *tls.Config) (*tls.Config, error) {
+    tc := &tls.Config{MinVersion: tls.VersionTLS12}
+    if base != nil {
+        tc = base.Clone()
+    }
+    if cfg.TLSServerName != "" {
+        tc.ServerName = cfg.TLSServerName
+    }
+    tc.InsecureSkipVerify = tc.InsecureSkipVerify || cfg.TLSInsecureSkipVerify
+
+    if cfg.TLSCAFile != "" {
+        pem, err := os.ReadFile(cfg.TLSCAFile)
+        if err != nil {
+            return nil, fmt.Errorf("redis: read tls ca: %w", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("redis: no certificates found in %s", cfg.TLSCAFile)
+        }
+        tc.RootCAs = pool
+    }
+    if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("redis: load client certificate: %w", err)
+        }
+        tc.Certificates = []tls.Certificate{cert}
+    }
+    return tc, nil
+}
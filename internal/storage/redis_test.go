@@ -0,0 +1,71 @@
+package storage
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// clusterSlot is the Redis Cluster hash slot of key: CRC16 (XMODEM) of the hash tag
+// when the key has a non-empty one, of the whole key otherwise, modulo 16384.
+func clusterSlot(key string) uint16 {
+    if start := strings.IndexByte(key, '{'); start >= 0 {
+        if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+            key = key[start+1 : start+1+end]
+        }
+    }
+    var crc uint16
+    for i := 0; i < len(key); i++ {
+        crc ^= uint16(key[i]) << 8
+        for bit := 0; bit < 8; bit++ {
+            if crc&0x8000 != 0 {
+                crc = crc<<1 ^ 0x1021
+            } else {
+                crc <<= 1
+            }
+        }
+    }
+    return crc % 16384
+}
+
+func TestRedis_ClusterKeysShareASlot(t *testing.T) {
+    // reference values from the Redis Cluster specification and CLUSTER KEYSLOT
+    if got := clusterSlot("123456789"); got != 0x31C3 {
+        t.Fatalf("unexpected crc16 of the reference string: %d", got)
+    }
+    if got := clusterSlot("foo"); got != 12182 {
+        t.Fatalf("unexpected slot of foo: %d", got)
+    }
+    if clusterSlot("{user1000}.following") != clusterSlot("{user1000}.followers") {
+        t.Fatalf("expected keys with the same hash tag to share a slot")
+    }
+
+    opts, err := RedisConfig{Mode: "cluster", Addrs: []string{"a:1", "b:2"}}.UniversalOptions()
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    r := NewUniversalRedisStorage(opts)
+    defer r.Close()
+    if !r.hashTags {
+        t.Fatalf("expected cluster options to enable hash tags")
+    }
+    r.SetPrefix("checkout:")
+
+    for _, key := range []string{"ip:1.2.3.4", "tenant:acme|failures|token:abc123", "GET /orders|ip:::1"} {
+        slot := clusterSlot(r.counterKey(key))
+        if clusterSlot(r.blockedKey(key)) != slot || clusterSlot(r.concurrencyKey(key)) != slot {
+            t.Fatalf("expected the keys of %q in one slot: %q %q %q", key, r.counterKey(key), r.blockedKey(key), r.concurrencyKey(key))
+        }
+    }
+    // the tag holds the identifier, not just the prefix every key shares
+    if clusterSlot(r.counterKey("ip:1.2.3.4")) == clusterSlot(r.counterKey("ip:5.6.7.8")) {
+        t.Fatalf("expected different identifiers to spread over slots")
+    }
+
+    single := NewUniversalRedisStorage(&redis.UniversalOptions{Addrs: []string{"a:1"}})
+    defer single.Close()
+    if single.hashTags {
+        t.Fatalf("expected no hash tags outside cluster mode")
+    }
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+// sqlMigrations create the schema, one statement per version. Only ever append: the
+// applied version is recorded in ratelimit_schema_migrations. Expiries are unix
+// milliseconds so the same statements work on PostgreSQL and SQLite.
+var sqlMigrations = []string{
+    `CREATE TABLE IF NOT EXISTS ratelimit_counters (
+        id TEXT PRIMARY KEY,
+        count BIGINT NOT NULL,
+        expires_at BIGINT NOT NULL
+    )`,
+    `CREATE TABLE IF NOT EXISTS ratelimit_blocks (
+        id TEXT PRIMARY KEY,
+        expires_at BIGINT NOT NULL
+    )`,
+    `CREATE INDEX IF NOT EXISTS ratelimit_counters_expires_at ON ratelimit_counters (expires_at)`,
+    `CREATE INDEX IF NOT EXISTS ratelimit_blocks_expires_at ON ratelimit_blocks (expires_at)`,
+}
+
+// SQLStorage keeps counters and blocks in a SQL database through database/sql, for
+// quotas that must be durable and can be audited with plain queries. It works with
+// PostgreSQL and SQLite (3.35+), both of which support INSERT ... ON CONFLICT ...
+// RETURNING, so every increment is a single atomic statement.
+//
+// Expiries use the clock of the instance writing them, so instances sharing a
+// database should keep their clocks in sync. Expired rows are ignored on read and
+// deleted by Cleanup, which runs every cleanup interval.
+type SQLStorage struct {
+    db  *sql.DB
+    now func() time.Time
+
+    stop      chan struct{}
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+// NewSQLStorage applies the pending migrations to db and starts deleting expired rows
+// every cleanupInterval (no background cleanup when not positive). The storage takes
+// ownership of db and closes it in Close.
+func NewSQLStorage(db *sql.DB, cleanupInterval time.Duration) (*SQLStorage, error) {
+    if err := MigrateSQL(context.Background(), db); err != nil {
+        return nil, err
+    }
+    s := &SQLStorage{db: db, now: time.Now, stop: make(chan struct{}), done: make(chan struct{})}
+    if cleanupInterval > 0 {
+        go s.run(cleanupInterval)
+    } else {
+        close(s.done)
+    }
+    return s, nil
+}
+
+// sqlMigrationLock is the PostgreSQL advisory lock held while migrating.
+const sqlMigrationLock = 7_236_111_605
+
+// MigrateSQL brings the schema up to date. On PostgreSQL it holds an advisory lock
+// while doing so: concurrent CREATE ... IF NOT EXISTS statements can still fail there
+// on the system catalogs, so instances starting at the same time take turns and the
+// later ones find the schema current. SQLite serialises the writes itself.
+func MigrateSQL(ctx context.Context, db *sql.DB) error {
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if isPostgres(ctx, conn) {
+        if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, sqlMigrationLock); err != nil {
+            return fmt.Errorf("locking migrations: %w", err)
+        }
+        // the lock belongs to the session, which goes back to the pool
+        defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, sqlMigrationLock)
+    }
+
+    _, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS ratelimit_schema_migrations (
+        version INTEGER PRIMARY KEY,
+        applied_at BIGINT NOT NULL
+    )`)
+    if err != nil {
+        return fmt.Errorf("creating migrations table: %w", err)
+    }
+    var current int
+    if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM ratelimit_schema_migrations`).Scan(&current); err != nil {
+        return fmt.Errorf("reading schema version: %w", err)
+    }
+    for i := current; i < len(sqlMigrations); i++ {
+        version := i + 1
+        if err := applySQLMigration(ctx, conn, version, sqlMigrations[i]); err != nil {
+            return fmt.Errorf("applying migration %d: %w", version, err)
+        }
+    }
+    return nil
+}
+
+// isPostgres reports whether conn is a PostgreSQL session; SQLite has no version().
+func isPostgres(ctx context.Context, conn *sql.Conn) bool {
+    var version string
+    if err := conn.QueryRowContext(ctx, `SELECT version()`).Scan(&version); err != nil {
+        return false
+    }
+    return strings.HasPrefix(version, "PostgreSQL")
+}
+
+func applySQLMigration(ctx context.Context, conn *sql.Conn, version int, stmt string) error {
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, stmt); err != nil {
+        return err
+    }
+    _, err = tx.ExecContext(ctx,
+        `INSERT INTO ratelimit_schema_migrations (version, applied_at) VALUES ($1, $2) ON CONFLICT (version) DO NOTHING`,
+        version, time.Now().UnixMilli())
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (s *SQLStorage) run(interval time.Duration) {
+    defer close(s.done)
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.stop:
+            return
+        case <-ticker.C:
+            _ = s.Cleanup()
+        }
+    }
+}
+
+// Close stops the cleanup and closes the database.
+func (s *SQLStorage) Close() error {
+    s.closeOnce.Do(func() { close(s.stop) })
+    <-s.done
+    return s.db.Close()
+}
+
+// Ping pings the database.
+func (s *SQLStorage) Ping(ctx context.Context) error {
+    return s.db.PingContext(ctx)
+}
+
+func (s *SQLStorage) Increment(key string, window time.Duration) (int64, error) {
+    return s.IncrementBy(key, 1, window)
+}
+
+// IncrementBy upserts the counter: a missing or expired row restarts at n with a new
+// window, a live one is incremented and keeps its expiry. A decrement only updates a
+// live row, stopping at zero.
+func (s *SQLStorage) IncrementBy(key string, n int64, window time.Duration) (int64, error) {
+    ctx := context.Background()
+    now := s.now()
+    var count int64
+    if n < 0 {
+        err := s.db.QueryRowContext(ctx, `
+            UPDATE ratelimit_counters
+            SET count = CASE WHEN count + $2 < 0 THEN 0 ELSE count + $2 END
+            WHERE id = $1 AND expires_at > $3
+            RETURNING count`,
+            key, n, now.UnixMilli()).Scan(&count)
+        if errors.Is(err, sql.ErrNoRows) {
+            return 0, nil
+        }
+        return count, err
+    }
+    err := s.db.QueryRowContext(ctx, `
+        INSERT INTO ratelimit_counters (id, count, expires_at) VALUES ($1, $2, $3)
+        ON CONFLICT (id) DO UPDATE SET
+            count = CASE WHEN ratelimit_counters.expires_at <= $4
+                THEN excluded.count ELSE ratelimit_counters.count + excluded.count END,
+            expires_at = CASE WHEN ratelimit_counters.expires_at <= $4
+                THEN excluded.expires_at ELSE ratelimit_counters.expires_at END
+        RETURNING count`,
+        key, n, now.Add(window).UnixMilli(), now.UnixMilli()).Scan(&count)
+    if err != nil {
+        return 0, err
+    }
+    return count, nil
+}
+
+func (s *SQLStorage) Get(key string) (int64, time.Duration, error) {
+    ctx := context.Background()
+    now := s.now()
+    var count, expiresAt int64
+    err := s.db.QueryRowContext(ctx,
+        `SELECT count, expires_at FROM ratelimit_counters WHERE id = $1 AND expires_at > $2`,
+        key, now.UnixMilli()).Scan(&count, &expiresAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return 0, 0, nil
+    }
+    if err != nil {
+        return 0, 0, err
+    }
+    return count, time.UnixMilli(expiresAt).Sub(now), nil
+}
+
+func (s *SQLStorage) Touch(key string, ttl time.Duration) error {
+    now := s.now()
+    _, err := s.db.ExecContext(context.Background(),
+        `UPDATE ratelimit_counters SET expires_at = $2 WHERE id = $1 AND expires_at > $3`,
+        key, now.Add(ttl).UnixMilli(), now.UnixMilli())
+    return err
+}
+
+func (s *SQLStorage) SetBlocked(key string, duration time.Duration) error {
+    ctx := context.Background()
+    _, err := s.db.ExecContext(ctx, `
+        INSERT INTO ratelimit_blocks (id, expires_at) VALUES ($1, $2)
+        ON CONFLICT (id) DO UPDATE SET expires_at = excluded.expires_at`,
+        key, s.now().Add(duration).UnixMilli())
+    return err
+}
+
+func (s *SQLStorage) IsBlocked(key string) (bool, time.Duration, error) {
+    ctx := context.Background()
+    now := s.now()
+    var expiresAt int64
+    err := s.db.QueryRowContext(ctx,
+        `SELECT expires_at FROM ratelimit_blocks WHERE id = $1 AND expires_at > $2`,
+        key, now.UnixMilli()).Scan(&expiresAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return false, 0, nil
+    }
+    if err != nil {
+        return false, 0, err
+    }
+    return true, time.UnixMilli(expiresAt).Sub(now), nil
+}
+
+// Unblock deletes the block on key.
+func (s *SQLStorage) Unblock(key string) error {
+    ctx := context.Background()
+    _, err := s.db.ExecContext(ctx, `DELETE FROM ratelimit_blocks WHERE id = $1`, key)
+    return err
+}
+
+// Cleanup deletes expired counters and blocks.
+func (s *SQLStorage) Cleanup() error {
+    ctx := context.Background()
+    now := s.now().UnixMilli()
+    if _, err := s.db.ExecContext(ctx, `DELETE FROM ratelimit_counters WHERE expires_at <= $1`, now); err != nil {
+        return err
+    }
+    _, err := s.db.ExecContext(ctx, `DELETE FROM ratelimit_blocks WHERE expires_at <= $1`, now)
+    return err
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+
+    _ "github.com/jackc/pgx/v5/stdlib"
+    _ "modernc.org/sqlite"
+)
+
+func newTestSQLStorage(t *testing.T) *SQLStorage {
+    t.Helper()
+    dsn := "file:" + filepath.Join(t.TempDir(), "ratelimit.sqlite") + "?_pragma=busy_timeout(5000)"
+    db, err := sql.Open("sqlite", dsn)
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    s, err := NewSQLStorage(db, 0)
+    if err != nil {
+        t.Fatalf("new sql storage: %v", err)
+    }
+    t.Cleanup(func() { s.Close() })
+    return s
+}
+
+func TestSQL_MigrationsAreIdempotent(t *testing.T) {
+    s := newTestSQLStorage(t)
+    if err := MigrateSQL(context.Background(), s.db); err != nil {
+        t.Fatalf("second migration run: %v", err)
+    }
+    var applied, max int
+    if err := s.db.QueryRow(`SELECT COUNT(*), MAX(version) FROM ratelimit_schema_migrations`).Scan(&applied, &max); err != nil {
+        t.Fatalf("reading versions: %v", err)
+    }
+    if applied != len(sqlMigrations) || max != len(sqlMigrations) {
+        t.Fatalf("expected %d migrations recorded once, got %d (max %d)", len(sqlMigrations), applied, max)
+    }
+}
+
+// instances starting together all migrate the same fresh database
+func testConcurrentMigrations(t *testing.T, db *sql.DB) {
+    var wg sync.WaitGroup
+    errs := make(chan error, 4)
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            errs <- MigrateSQL(context.Background(), db)
+        }()
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        if err != nil {
+            t.Fatalf("concurrent migration: %v", err)
+        }
+    }
+    var applied int
+    if err := db.QueryRow(`SELECT COUNT(*) FROM ratelimit_schema_migrations`).Scan(&applied); err != nil {
+        t.Fatalf("reading versions: %v", err)
+    }
+    if applied != len(sqlMigrations) {
+        t.Fatalf("expected %d migrations recorded once, got %d", len(sqlMigrations), applied)
+    }
+}
+
+func TestSQL_ConcurrentMigrations(t *testing.T) {
+    dsn := "file:" + filepath.Join(t.TempDir(), "ratelimit.sqlite") + "?_pragma=busy_timeout(5000)"
+    db, err := sql.Open("sqlite", dsn)
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    defer db.Close()
+    testConcurrentMigrations(t, db)
+}
+
+// SQL_TEST_POSTGRES_DSN points at a scratch PostgreSQL database; its ratelimit_ tables
+// are dropped first.
+func TestSQL_ConcurrentMigrationsPostgres(t *testing.T) {
+    dsn := os.Getenv("SQL_TEST_POSTGRES_DSN")
+    if dsn == "" {
+        t.Skip("SQL_TEST_POSTGRES_DSN not set")
+    }
+    db, err := sql.Open("pgx", dsn)
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    defer db.Close()
+    for _, table := range []string{"ratelimit_counters", "ratelimit_blocks", "ratelimit_schema_migrations"} {
+        if _, err := db.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+            t.Fatalf("drop %s: %v", table, err)
+        }
+    }
+    testConcurrentMigrations(t, db)
+}
+
+func TestSQL_IncrementWindowAndCleanup(t *testing.T) {
+    s := newTestSQLStorage(t)
+
+    if c, _ := s.Increment("ip:1", 100*time.Millisecond); c != 1 {
+        t.Fatalf("expected 1, got %d", c)
+    }
+    if c, _ := s.IncrementBy("ip:1", 4, time.Minute); c != 5 {
+        t.Fatalf("expected 5, got %d", c)
+    }
+    // the window is kept from the first increment
+    if c, ttl, _ := s.Get("ip:1"); c != 5 || ttl <= 0 || ttl > 100*time.Millisecond {
+        t.Fatalf("expected 5 with the first window's ttl, got %d %v", c, ttl)
+    }
+    time.Sleep(120 * time.Millisecond)
+    if c, ttl, _ := s.Get("ip:1"); c != 0 || ttl != 0 {
+        t.Fatalf("expected expired counter to read as 0, got %d %v", c, ttl)
+    }
+    if c, _ := s.Increment("ip:1", time.Minute); c != 1 {
+        t.Fatalf("expected a new window to restart at 1, got %d", c)
+    }
+
+    s.Increment("stale", time.Millisecond)
+    s.SetBlocked("stale", time.Millisecond)
+    time.Sleep(5 * time.Millisecond)
+    if err := s.Cleanup(); err != nil {
+        t.Fatalf("cleanup: %v", err)
+    }
+    var counters, blocks int
+    s.db.QueryRow(`SELECT COUNT(*) FROM ratelimit_counters`).Scan(&counters)
+    s.db.QueryRow(`SELECT COUNT(*) FROM ratelimit_blocks`).Scan(&blocks)
+    if counters != 1 || blocks != 0 {
+        t.Fatalf("expected only the live counter left, got %d counters %d blocks", counters, blocks)
+    }
+}
+
+func TestSQL_ConcurrentIncrementsAreAtomic(t *testing.T) {
+    s := newTestSQLStorage(t)
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 5; j++ {
+                if _, err := s.Increment("hot", time.Minute); err != nil {
+                    t.Errorf("increment: %v", err)
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if c, _, _ := s.Get("hot"); c != 100 {
+        t.Fatalf("expected 100, got %d", c)
+    }
+}
+
+func TestSQL_BlockAndUnblock(t *testing.T) {
+    s := newTestSQLStorage(t)
+    if blocked, _, _ := s.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected not blocked")
+    }
+    if err := s.SetBlocked("ip:1", time.Minute); err != nil {
+        t.Fatalf("set blocked: %v", err)
+    }
+    if blocked, ttl, _ := s.IsBlocked("ip:1"); !blocked || ttl <= 0 || ttl > time.Minute {
+        t.Fatalf("expected blocked, got %v %v", blocked, ttl)
+    }
+    if err := s.Unblock("ip:1"); err != nil {
+        t.Fatalf("unblock: %v", err)
+    }
+    if blocked, _, _ := s.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected unblocked")
+    }
+}
@@ -1,6 +1,22 @@
 package storage
 
-import "time"
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+var (
+    // ErrSemaphoreUnsupported is returned by decorators whose backend does not implement Semaphore.
+    ErrSemaphoreUnsupported = errors.New("storage: backend does not support semaphores")
+
+    // ErrTouchUnsupported is returned by decorators whose backend does not implement Toucher.
+    ErrTouchUnsupported = errors.New("storage: backend does not support touching counters")
+
+    // ErrUnblockUnsupported is returned when the storage cannot lift blocks early
+    // (Unblocker) or announce them (UnblockWatcher).
+    ErrUnblockUnsupported = errors.New("storage: backend does not support unblocking")
+)
 
 // Storage defines the persistence operations required by the limiter.
 type Storage interface {
@@ -8,9 +24,54 @@ type Storage interface {
     // The counter should expire after window seconds.
     Increment(key string, window time.Duration) (int64, error)
 
+    // IncrementBy adds n (which may be negative) to the counter for key and returns the new count.
+    // Like Increment, the counter expires window after it was created. Counters never go
+    // below zero, and a negative n on a missing or expired counter returns 0 without
+    // starting a window, so taking back units never reaches into the next window.
+    IncrementBy(key string, n int64, window time.Duration) (int64, error)
+
+    // Get returns the current count for key and the time left until it expires, without changing it.
+    // A missing key returns 0 and 0.
+    Get(key string) (int64, time.Duration, error)
+
     // SetBlocked marks an identifier as blocked for the given duration.
     SetBlocked(key string, duration time.Duration) error
 
     // IsBlocked returns whether the identifier is currently blocked and remaining block duration.
     IsBlocked(key string) (bool, time.Duration, error)
+
+    // Ping checks that the backend is reachable, for readiness probes.
+    Ping(ctx context.Context) error
+}
+
+// Semaphore is implemented by storages that support distributed concurrency limits.
+// Slots are leases: a holder that crashes loses its slot once the lease expires.
+type Semaphore interface {
+    // Acquire takes one of limit slots for key, returning an id for the slot and whether it was acquired.
+    Acquire(key string, limit int, lease time.Duration) (string, bool, error)
+
+    // Refresh extends the lease of a held slot. It returns false if the slot already expired.
+    Refresh(key, id string, lease time.Duration) (bool, error)
+
+    // Release frees a held slot.
+    Release(key, id string) error
+}
+
+// Toucher is implemented by storages that can move the expiry of a live counter.
+type Toucher interface {
+    // Touch makes the counter for key expire ttl from now, keeping its count. A missing
+    // or expired counter stays missing.
+    Touch(key string, ttl time.Duration) error
+}
+
+// Unblocker is implemented by storages that can lift a block before it expires.
+type Unblocker interface {
+    Unblock(key string) error
+}
+
+// UnblockWatcher is implemented by storages that announce unblocks to every instance,
+// so local caches of blocked keys can be invalidated.
+type UnblockWatcher interface {
+    // WatchUnblocks calls fn with the key of every Unblock, from any instance, until ctx is done.
+    WatchUnblocks(ctx context.Context, fn func(key string)) error
 }
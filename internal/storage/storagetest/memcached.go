@@ -0,0 +1,180 @@
+package storagetest
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeMemcached speaks the part of the memcached text protocol used by gomemcache:
+// gets, set, add, cas, incr, decr, delete and version. Expirations follow memcached:
+// seconds from now up to 30 days, unix timestamps above.
+type fakeMemcached struct {
+    mu    sync.Mutex
+    items map[string]fakeItem
+    cas   uint64
+}
+
+type fakeItem struct {
+    value   []byte
+    flags   uint32
+    expires time.Time // zero: never
+    cas     uint64
+}
+
+// NewMemcachedServer starts an in-process memcached stand-in for the duration of the
+// test and returns its address.
+func NewMemcachedServer(t *testing.T) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen: %v", err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    f := &fakeMemcached{items: map[string]fakeItem{}}
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go f.serve(conn)
+        }
+    }()
+    return ln.Addr().String()
+}
+
+func (f *fakeMemcached) serve(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    w := bufio.NewWriter(conn)
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return
+        }
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+        switch cmd := fields[0]; cmd {
+        case "gets", "get":
+            f.get(w, fields[1:])
+        case "set", "add", "cas":
+            if len(fields) < 5 || cmd == "cas" && len(fields) < 6 {
+                fmt.Fprint(w, "ERROR\r\n")
+                break
+            }
+            size, _ := strconv.Atoi(fields[4])
+            data := make([]byte, size+2)
+            if _, err := io.ReadFull(r, data); err != nil {
+                return
+            }
+            flags, _ := strconv.ParseUint(fields[2], 10, 32)
+            exp, _ := strconv.ParseInt(fields[3], 10, 64)
+            var unique uint64
+            if cmd == "cas" {
+                unique, _ = strconv.ParseUint(fields[5], 10, 64)
+            }
+            fmt.Fprint(w, f.store(cmd, fields[1], data[:size], uint32(flags), exp, unique))
+        case "incr", "decr":
+            delta, _ := strconv.ParseUint(fields[2], 10, 64)
+            fmt.Fprint(w, f.incr(fields[1], delta, cmd == "decr"))
+        case "delete":
+            fmt.Fprint(w, f.delete(fields[1]))
+        case "version":
+            fmt.Fprint(w, "VERSION fake\r\n")
+        default:
+            fmt.Fprint(w, "ERROR\r\n")
+        }
+        if err := w.Flush(); err != nil {
+            return
+        }
+    }
+}
+
+// lookup returns the live item for key. Callers hold mu.
+func (f *fakeMemcached) lookup(key string) (fakeItem, bool) {
+    it, ok := f.items[key]
+    if ok && !it.expires.IsZero() && !time.Now().Before(it.expires) {
+        delete(f.items, key)
+        return fakeItem{}, false
+    }
+    return it, ok
+}
+
+func (f *fakeMemcached) get(w io.Writer, keys []string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    for _, key := range keys {
+        if it, ok := f.lookup(key); ok {
+            fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", key, it.flags, len(it.value), it.cas, it.value)
+        }
+    }
+    fmt.Fprint(w, "END\r\n")
+}
+
+func (f *fakeMemcached) store(cmd, key string, value []byte, flags uint32, exp int64, unique uint64) string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    it, ok := f.lookup(key)
+    switch {
+    case ok && cmd == "add":
+        return "NOT_STORED\r\n"
+    case !ok && cmd == "cas":
+        return "NOT_FOUND\r\n"
+    case ok && cmd == "cas" && it.cas != unique:
+        return "EXISTS\r\n"
+    }
+    var expires time.Time
+    switch {
+    case exp > 30*24*60*60:
+        expires = time.Unix(exp, 0)
+    case exp > 0:
+        expires = time.Now().Add(time.Duration(exp) * time.Second)
+    }
+    f.cas++
+    f.items[key] = fakeItem{value: append([]byte(nil), value...), flags: flags, expires: expires, cas: f.cas}
+    return "STORED\r\n"
+}
+
+func (f *fakeMemcached) incr(key string, delta uint64, decr bool) string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    it, ok := f.lookup(key)
+    if !ok {
+        return "NOT_FOUND\r\n"
+    }
+    v, err := strconv.ParseUint(strings.TrimSpace(string(it.value)), 10, 64)
+    if err != nil {
+        return "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"
+    }
+    switch {
+    case !decr:
+        v += delta
+    case delta > v:
+        v = 0
+    default:
+        v -= delta
+    }
+    f.cas++
+    it.value, it.cas = []byte(strconv.FormatUint(v, 10)), f.cas
+    f.items[key] = it
+    return strconv.FormatUint(v, 10) + "\r\n"
+}
+
+func (f *fakeMemcached) delete(key string) string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if _, ok := f.lookup(key); !ok {
+        return "NOT_FOUND\r\n"
+    }
+    delete(f.items, key)
+    return "DELETED\r\n"
+}
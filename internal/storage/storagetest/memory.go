@@ -0,0 +1,256 @@
+package storagetest
+
+import (
+    "context"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Memory is an in-memory storage.Storage that passes Run, for tests of code built on
+// storage: it implements Toucher, Unblocker, UnblockWatcher and Semaphore too. It also counts
+// the calls made to it and can make IncrementBy fail or slow down.
+type Memory struct {
+    mu       sync.Mutex
+    counters map[string]memoryCounter
+    blocked  map[string]time.Time
+    slots    map[string]map[string]time.Time
+    nextID   int
+    watchers map[int]func(string)
+    watchID  int
+
+    calls    int
+    incrErr  error
+    incrWait time.Duration
+}
+
+type memoryCounter struct {
+    count   int64
+    expires time.Time
+}
+
+// NewMemory returns an empty Memory.
+func NewMemory() *Memory {
+    return &Memory{
+        counters: make(map[string]memoryCounter),
+        blocked:  make(map[string]time.Time),
+        slots:    make(map[string]map[string]time.Time),
+        watchers: make(map[int]func(string)),
+    }
+}
+
+func (m *Memory) Increment(key string, window time.Duration) (int64, error) {
+    return m.IncrementBy(key, 1, window)
+}
+
+func (m *Memory) IncrementBy(key string, n int64, window time.Duration) (int64, error) {
+    m.mu.Lock()
+    wait := m.incrWait
+    m.mu.Unlock()
+    time.Sleep(wait)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    if m.incrErr != nil {
+        return 0, m.incrErr
+    }
+    now := time.Now()
+    c, ok := m.counters[key]
+    if !ok || !now.Before(c.expires) {
+        if n < 0 {
+            // nothing to take from: no window starts
+            delete(m.counters, key)
+            return 0, nil
+        }
+        c = memoryCounter{expires: now.Add(window)}
+    }
+    c.count += n
+    if c.count < 0 {
+        c.count = 0
+    }
+    m.counters[key] = c
+    return c.count, nil
+}
+
+func (m *Memory) Touch(key string, ttl time.Duration) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    now := time.Now()
+    if c, ok := m.counters[key]; ok && now.Before(c.expires) {
+        c.expires = now.Add(ttl)
+        m.counters[key] = c
+    }
+    return nil
+}
+
+func (m *Memory) Get(key string) (int64, time.Duration, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    now := time.Now()
+    c, ok := m.counters[key]
+    if !ok || !now.Before(c.expires) {
+        return 0, 0, nil
+    }
+    return c.count, c.expires.Sub(now), nil
+}
+
+func (m *Memory) SetBlocked(key string, duration time.Duration) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    if duration <= 0 {
+        delete(m.blocked, key)
+        return nil
+    }
+    m.blocked[key] = time.Now().Add(duration)
+    return nil
+}
+
+func (m *Memory) IsBlocked(key string) (bool, time.Duration, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    until, ok := m.blocked[key]
+    now := time.Now()
+    if !ok || !now.Before(until) {
+        delete(m.blocked, key)
+        return false, 0, nil
+    }
+    return true, until.Sub(now), nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+    return ctx.Err()
+}
+
+// Unblock lifts the block on key and tells the watchers, like Redis pub/sub.
+func (m *Memory) Unblock(key string) error {
+    m.mu.Lock()
+    m.calls++
+    delete(m.blocked, key)
+    var watchers []func(string)
+    for _, fn := range m.watchers {
+        watchers = append(watchers, fn)
+    }
+    m.mu.Unlock()
+    for _, fn := range watchers {
+        fn(key)
+    }
+    return nil
+}
+
+// WatchUnblocks calls fn for every key unblocked until ctx is done.
+func (m *Memory) WatchUnblocks(ctx context.Context, fn func(key string)) error {
+    m.mu.Lock()
+    m.watchID++
+    id := m.watchID
+    m.watchers[id] = fn
+    m.mu.Unlock()
+    <-ctx.Done()
+    m.mu.Lock()
+    delete(m.watchers, id)
+    m.mu.Unlock()
+    return nil
+}
+
+func (m *Memory) Acquire(key string, limit int, lease time.Duration) (string, bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    now := time.Now()
+    held := m.slots[key]
+    if held == nil {
+        held = make(map[string]time.Time)
+        m.slots[key] = held
+    }
+    for id, until := range held {
+        if !now.Before(until) {
+            delete(held, id)
+        }
+    }
+    if len(held) >= limit {
+        return "", false, nil
+    }
+    m.nextID++
+    id := strconv.Itoa(m.nextID)
+    held[id] = now.Add(lease)
+    return id, true, nil
+}
+
+func (m *Memory) Refresh(key, id string, lease time.Duration) (bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    until, ok := m.slots[key][id]
+    if !ok || !time.Now().Before(until) {
+        return false, nil
+    }
+    m.slots[key][id] = time.Now().Add(lease)
+    return true, nil
+}
+
+func (m *Memory) Release(key, id string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.calls++
+    delete(m.slots[key], id)
+    return nil
+}
+
+// Expire ends the counter and the block of key at once, as if both had run out.
+func (m *Memory) Expire(key string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    delete(m.counters, key)
+    delete(m.blocked, key)
+}
+
+// Keys returns the keys of the live counters and blocks.
+func (m *Memory) Keys() []string {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    var keys []string
+    for k, c := range m.counters {
+        if now.Before(c.expires) {
+            keys = append(keys, k)
+        }
+    }
+    for k, until := range m.blocked {
+        if now.Before(until) {
+            keys = append(keys, "blocked:"+k)
+        }
+    }
+    return keys
+}
+
+// Calls returns how many storage calls were made, Ping aside.
+func (m *Memory) Calls() int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.calls
+}
+
+// Watchers returns how many WatchUnblocks calls are listening.
+func (m *Memory) Watchers() int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return len(m.watchers)
+}
+
+// FailIncrements makes IncrementBy return err (nil restores it).
+func (m *Memory) FailIncrements(err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.incrErr = err
+}
+
+// SlowIncrements makes every IncrementBy wait d before it runs.
+func (m *Memory) SlowIncrements(d time.Duration) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.incrWait = d
+}
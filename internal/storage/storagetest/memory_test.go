@@ -0,0 +1,11 @@
+package storagetest
+
+import (
+    "testing"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+)
+
+func TestMemory(t *testing.T) {
+    Run(t, func(t *testing.T) storage.Storage { return NewMemory() })
+}
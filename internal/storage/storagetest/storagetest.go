@@ -0,0 +1,332 @@
+// Package storagetest is a conformance suite for storage.Storage implementations.
+// Every backend and decorator runs it, so they all behave like the Redis storage the
+// limiter was written against.
+package storagetest
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage"
+)
+
+// Factory returns an empty storage for one test; it should register its cleanup
+// with t.Cleanup.
+type Factory func(t *testing.T) storage.Storage
+
+// expiry is the shortest window the suite waits for. Backends with second
+// granularity (Redis EXPIRE, memcached) cannot go below a second.
+const expiry = time.Second
+
+// Run runs the conformance suite against the storages returned by newStorage.
+// Toucher, Unblocker and Semaphore are checked when the storage implements them. Memory is the
+// reference: it passes the suite and stands in for a backend in other packages' tests.
+func Run(t *testing.T, newStorage Factory) {
+    t.Run("Increment", func(t *testing.T) { testIncrement(t, newStorage(t)) })
+    t.Run("IncrementBy", func(t *testing.T) { testIncrementBy(t, newStorage(t)) })
+    t.Run("GetMissing", func(t *testing.T) { testGetMissing(t, newStorage(t)) })
+    t.Run("ConcurrentIncrements", func(t *testing.T) { testConcurrentIncrements(t, newStorage(t)) })
+    t.Run("Blocks", func(t *testing.T) { testBlocks(t, newStorage(t)) })
+    t.Run("ZeroBlock", func(t *testing.T) { testZeroBlock(t, newStorage(t)) })
+    t.Run("LongTTL", func(t *testing.T) { testLongTTL(t, newStorage(t)) })
+    t.Run("Ping", func(t *testing.T) { testPing(t, newStorage(t)) })
+    t.Run("Touch", func(t *testing.T) { testTouch(t, newStorage(t)) })
+    t.Run("Unblock", func(t *testing.T) { testUnblock(t, newStorage(t)) })
+    t.Run("Expiry", func(t *testing.T) {
+        t.Parallel()
+        testExpiry(t, newStorage(t))
+    })
+    t.Run("Semaphore", func(t *testing.T) {
+        t.Parallel()
+        testSemaphore(t, newStorage(t))
+    })
+}
+
+func testIncrement(t *testing.T, s storage.Storage) {
+    for want := int64(1); want <= 3; want++ {
+        got, err := s.Increment("ip:1", time.Minute)
+        if err != nil || got != want {
+            t.Fatalf("increment %d: got %d, %v", want, got, err)
+        }
+    }
+    if got, _ := s.Increment("ip:2", time.Minute); got != 1 {
+        t.Fatalf("expected keys to be independent, got %d", got)
+    }
+    count, ttl, err := s.Get("ip:1")
+    if err != nil || count != 3 {
+        t.Fatalf("get: got %d, %v", count, err)
+    }
+    if ttl <= 0 || ttl > time.Minute {
+        t.Fatalf("expected ttl in (0, 1m], got %v", ttl)
+    }
+}
+
+// testIncrementBy also pins the contract for negative n: counters stop at zero, and
+// taking from a missing or expired counter returns 0 without starting a window.
+func testIncrementBy(t *testing.T, s storage.Storage) {
+    steps := []struct {
+        n, want int64
+    }{{5, 5}, {-2, 3}, {1, 4}, {0, 4}, {-10, 0}, {4, 4}}
+    for _, st := range steps {
+        got, err := s.IncrementBy("k", st.n, time.Minute)
+        if err != nil || got != st.want {
+            t.Fatalf("IncrementBy(%d): expected %d, got %d, %v", st.n, st.want, got, err)
+        }
+    }
+    if got, _ := s.Increment("k", time.Minute); got != 5 {
+        t.Fatalf("expected Increment to continue the IncrementBy counter, got %d", got)
+    }
+    if count, _, _ := s.Get("k"); count != 5 {
+        t.Fatalf("expected 5, got %d", count)
+    }
+
+    if got, err := s.IncrementBy("missing", -3, time.Minute); err != nil || got != 0 {
+        t.Fatalf("expected a decrement of a missing counter to return 0, got %d, %v", got, err)
+    }
+    if count, ttl, _ := s.Get("missing"); count != 0 || ttl != 0 {
+        t.Fatalf("expected no window started by a decrement, got %d, %v", count, ttl)
+    }
+    if got, _ := s.IncrementBy("missing", 2, time.Minute); got != 2 {
+        t.Fatalf("expected the next increment to start from 0, got %d", got)
+    }
+}
+
+func testGetMissing(t *testing.T, s storage.Storage) {
+    count, ttl, err := s.Get("missing")
+    if err != nil || count != 0 || ttl != 0 {
+        t.Fatalf("expected 0, 0, nil for a missing key, got %d, %v, %v", count, ttl, err)
+    }
+}
+
+// testConcurrentIncrements checks atomicity: every increment sees a distinct count.
+func testConcurrentIncrements(t *testing.T, s storage.Storage) {
+    const workers, each = 8, 25
+    var mu sync.Mutex
+    seen := make(map[int64]bool)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < each; i++ {
+                got, err := s.Increment("hot", time.Minute)
+                if err != nil {
+                    t.Errorf("increment: %v", err)
+                    return
+                }
+                mu.Lock()
+                if seen[got] {
+                    t.Errorf("count %d returned twice", got)
+                }
+                seen[got] = true
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    if count, _, _ := s.Get("hot"); count != workers*each {
+        t.Fatalf("expected %d, got %d", workers*each, count)
+    }
+}
+
+func testBlocks(t *testing.T, s storage.Storage) {
+    if blocked, ttl, err := s.IsBlocked("ip:1"); err != nil || blocked || ttl != 0 {
+        t.Fatalf("expected not blocked, got %v, %v, %v", blocked, ttl, err)
+    }
+    if err := s.SetBlocked("ip:1", time.Minute); err != nil {
+        t.Fatalf("set blocked: %v", err)
+    }
+    blocked, ttl, err := s.IsBlocked("ip:1")
+    if err != nil || !blocked || ttl <= 0 || ttl > time.Minute {
+        t.Fatalf("expected blocked with ttl in (0, 1m], got %v, %v, %v", blocked, ttl, err)
+    }
+    if blocked, _, _ := s.IsBlocked("ip:2"); blocked {
+        t.Fatalf("expected other keys not blocked")
+    }
+    if count, _, _ := s.Get("ip:1"); count != 0 {
+        t.Fatalf("expected blocking to leave the counter alone, got %d", count)
+    }
+
+    // blocking again replaces the duration
+    if err := s.SetBlocked("ip:1", 2*time.Minute); err != nil {
+        t.Fatalf("set blocked again: %v", err)
+    }
+    if _, ttl, _ := s.IsBlocked("ip:1"); ttl <= time.Minute || ttl > 2*time.Minute {
+        t.Fatalf("expected the block extended to 2m, got %v", ttl)
+    }
+}
+
+func testZeroBlock(t *testing.T, s storage.Storage) {
+    if err := s.SetBlocked("ip:1", 0); err != nil {
+        t.Fatalf("set blocked: %v", err)
+    }
+    if blocked, ttl, _ := s.IsBlocked("ip:1"); blocked || ttl != 0 {
+        t.Fatalf("expected a zero block to block nothing, got %v, %v", blocked, ttl)
+    }
+}
+
+// testLongTTL uses a window longer than 30 days, past which memcached reads
+// expirations as timestamps.
+func testLongTTL(t *testing.T, s storage.Storage) {
+    const long = 40 * 24 * time.Hour
+    if _, err := s.Increment("quota", long); err != nil {
+        t.Fatalf("increment: %v", err)
+    }
+    if _, ttl, _ := s.Get("quota"); ttl <= long-5*time.Second || ttl > long {
+        t.Fatalf("expected ttl close to %v, got %v", long, ttl)
+    }
+    if err := s.SetBlocked("quota", long); err != nil {
+        t.Fatalf("set blocked: %v", err)
+    }
+    if blocked, ttl, _ := s.IsBlocked("quota"); !blocked || ttl <= long-5*time.Second || ttl > long {
+        t.Fatalf("expected block close to %v, got %v, %v", long, blocked, ttl)
+    }
+}
+
+func testPing(t *testing.T, s storage.Storage) {
+    if err := s.Ping(context.Background()); err != nil {
+        t.Fatalf("ping: %v", err)
+    }
+}
+
+func testTouch(t *testing.T, s storage.Storage) {
+    tc, ok := s.(storage.Toucher)
+    if !ok {
+        t.Skip("storage does not implement storage.Toucher")
+    }
+    if err := tc.Touch("missing", time.Hour); errors.Is(err, storage.ErrTouchUnsupported) {
+        t.Skip("backend does not support touching counters")
+    } else if err != nil {
+        t.Fatalf("touching a missing counter: %v", err)
+    }
+    if count, ttl, _ := s.Get("missing"); count != 0 || ttl != 0 {
+        t.Fatalf("expected a touched missing counter to stay missing, got %d, %v", count, ttl)
+    }
+
+    s.IncrementBy("k", 3, time.Minute)
+    if err := tc.Touch("k", time.Hour); err != nil {
+        t.Fatalf("touch: %v", err)
+    }
+    if count, ttl, _ := s.Get("k"); count != 3 || ttl <= time.Minute || ttl > time.Hour {
+        t.Fatalf("expected the count kept with the new expiry, got %d, %v", count, ttl)
+    }
+    // the window keeps the new expiry
+    if got, _ := s.Increment("k", time.Minute); got != 4 {
+        t.Fatalf("expected the touched counter to keep counting, got %d", got)
+    }
+    if _, ttl, _ := s.Get("k"); ttl <= time.Minute {
+        t.Fatalf("expected increments to keep the touched expiry, got %v", ttl)
+    }
+}
+
+func testUnblock(t *testing.T, s storage.Storage) {
+    u, ok := s.(storage.Unblocker)
+    if !ok {
+        t.Skip("storage does not implement storage.Unblocker")
+    }
+    if err := u.Unblock("missing"); errors.Is(err, storage.ErrUnblockUnsupported) {
+        t.Skip("backend does not support unblocking")
+    } else if err != nil {
+        t.Fatalf("unblocking a key that is not blocked: %v", err)
+    }
+    s.SetBlocked("ip:1", time.Minute)
+    s.SetBlocked("ip:2", time.Minute)
+    if err := u.Unblock("ip:1"); err != nil {
+        t.Fatalf("unblock: %v", err)
+    }
+    if blocked, _, _ := s.IsBlocked("ip:1"); blocked {
+        t.Fatalf("expected unblocked")
+    }
+    if blocked, _, _ := s.IsBlocked("ip:2"); !blocked {
+        t.Fatalf("expected other blocks kept")
+    }
+}
+
+// testExpiry sets everything up first and waits once, so the suite stays fast.
+func testExpiry(t *testing.T, s storage.Storage) {
+    s.Increment("expiring", expiry)
+    // later increments do not extend the window
+    s.IncrementBy("expiring", 2, time.Hour)
+    s.Increment("kept", time.Hour)
+    s.SetBlocked("blocked", expiry)
+    tc, touches := s.(storage.Toucher)
+    if touches {
+        s.Increment("touched", expiry)
+        if err := tc.Touch("touched", time.Hour); errors.Is(err, storage.ErrTouchUnsupported) {
+            touches = false
+        }
+    }
+    time.Sleep(expiry + expiry/2)
+
+    if count, ttl, err := s.Get("expiring"); err != nil || count != 0 || ttl != 0 {
+        t.Fatalf("expected an expired counter to read 0, 0, got %d, %v, %v", count, ttl, err)
+    }
+    // taking back from the ended window must not reach into the next one
+    if got, err := s.IncrementBy("expiring", -1, time.Hour); err != nil || got != 0 {
+        t.Fatalf("expected a decrement of an expired counter to return 0, got %d, %v", got, err)
+    }
+    if got, _ := s.Increment("expiring", time.Hour); got != 1 {
+        t.Fatalf("expected a new window to restart at 1, got %d", got)
+    }
+    if _, ttl, _ := s.Get("expiring"); ttl <= expiry {
+        t.Fatalf("expected the new window to use the new duration, got ttl %v", ttl)
+    }
+    if count, _, _ := s.Get("kept"); count != 1 {
+        t.Fatalf("expected unexpired counters kept, got %d", count)
+    }
+    if blocked, ttl, err := s.IsBlocked("blocked"); err != nil || blocked || ttl != 0 {
+        t.Fatalf("expected the block to expire, got %v, %v, %v", blocked, ttl, err)
+    }
+    if count, _, _ := s.Get("touched"); touches && count != 1 {
+        t.Fatalf("expected a touched counter to outlive its window, got %d", count)
+    }
+}
+
+func testSemaphore(t *testing.T, s storage.Storage) {
+    sem, ok := s.(storage.Semaphore)
+    if !ok {
+        t.Skip("storage does not implement storage.Semaphore")
+    }
+    first, ok, err := sem.Acquire("k", 2, time.Minute)
+    if errors.Is(err, storage.ErrSemaphoreUnsupported) {
+        t.Skip("backend does not support semaphores")
+    }
+    if err != nil || !ok {
+        t.Fatalf("expected first slot, got %v, %v", ok, err)
+    }
+    second, ok, _ := sem.Acquire("k", 2, time.Minute)
+    if !ok || second == first {
+        t.Fatalf("expected a second, distinct slot, got %v %q", ok, second)
+    }
+    if _, ok, _ := sem.Acquire("k", 2, time.Minute); ok {
+        t.Fatalf("expected the limit to be enforced")
+    }
+    if _, ok, _ := sem.Acquire("other", 1, time.Minute); !ok {
+        t.Fatalf("expected keys to be independent")
+    }
+    if held, err := sem.Refresh("k", first, time.Minute); err != nil || !held {
+        t.Fatalf("expected refresh of a held slot, got %v, %v", held, err)
+    }
+    if err := sem.Release("k", first); err != nil {
+        t.Fatalf("release: %v", err)
+    }
+    if held, _ := sem.Refresh("k", first, time.Minute); held {
+        t.Fatalf("expected refresh of a released slot to fail")
+    }
+    if _, ok, _ := sem.Acquire("k", 2, time.Minute); !ok {
+        t.Fatalf("expected the released slot to be free")
+    }
+
+    // a holder that never releases loses its slot when the lease expires
+    lost, _, _ := sem.Acquire("lease", 1, expiry)
+    time.Sleep(expiry + expiry/2)
+    if held, _ := sem.Refresh("lease", lost, time.Minute); held {
+        t.Fatalf("expected refresh of an expired lease to fail")
+    }
+    if _, ok, _ := sem.Acquire("lease", 1, time.Minute); !ok {
+        t.Fatalf("expected the expired lease to free its slot")
+    }
+}
@@ -0,0 +1,277 @@
+package middleware
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "math"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+)
+
+// BandwidthLimit caps transferred bytes per identifier. Accounting is kept in storage,
+// so the rate and quota are shared by every instance.
+type BandwidthLimit struct {
+    // BytesPerSecond throttles response writes to this rate (0 disables throttling).
+    BytesPerSecond int64
+    // Quota rejects new requests with 429 once this many bytes were transferred within
+    // Window (0 disables the quota).
+    Quota  int64
+    Window time.Duration
+    // CountRequestBody also counts request body bytes towards the quota.
+    CountRequestBody bool
+}
+
+const (
+    bandwidthRateScope  = "bps"
+    bandwidthQuotaScope = "bytes"
+)
+
+// BandwidthHandler applies bl to next. Bytes are charged as they are written (and read,
+// with CountRequestBody), so a response is cut short once the quota is used up; since
+// the status line is already out by then, the handler's writes just start failing.
+func (m *LimiterMiddleware) BandwidthHandler(bl BandwidthLimit, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        apiKey := r.Header.Get("API_KEY")
+        ip := clientIP(r)
+        lim := m.limiterFor(r)
+
+        var quota *quotaMeter
+        if bl.Quota > 0 {
+            used, ttl, err := lim.Usage(bandwidthQuotaScope, ip, apiKey)
+            if err != nil {
+                http.Error(w, "internal error", http.StatusInternalServerError)
+                return
+            }
+            if used >= bl.Quota {
+                w.Header().Set("Content-Type", "application/json")
+                w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ttl.Seconds()))))
+                w.WriteHeader(http.StatusTooManyRequests)
+                body := map[string]string{"message": "bandwidth quota exceeded"}
+                _ = json.NewEncoder(w).Encode(body)
+                return
+            }
+            quota = &quotaMeter{limiter: lim, ip: ip, apiKey: apiKey, quota: bl.Quota, window: bl.Window}
+            defer quota.close()
+        }
+
+        tw := &throttledWriter{ResponseWriter: w, limiter: lim, ip: ip, apiKey: apiKey, rate: bl.BytesPerSecond, quota: quota, r: r}
+        if bl.CountRequestBody && quota != nil && r.Body != nil {
+            r.Body = &quotaReader{ReadCloser: r.Body, quota: quota}
+        }
+
+        next.ServeHTTP(tw, r)
+    })
+}
+
+// errBandwidthQuota is returned by writes and request body reads past the quota.
+var errBandwidthQuota = errors.New("bandwidth quota exceeded")
+
+// quotaSlice is how many quota bytes are reserved from storage at a time, so small
+// writes do not each cost a round trip. What a request does not use is handed back.
+const quotaSlice = 64 << 10
+
+// quotaMeter charges a request's bytes to the identifier's quota, reserving them from
+// storage in slices.
+type quotaMeter struct {
+    mu      sync.Mutex
+    limiter *limiter.Limiter
+    ip      string
+    apiKey  string
+    quota   int64
+    window  time.Duration
+
+    credit int64     // reserved in the current window and not used yet
+    live   time.Time // the window of credit runs at least until then
+    spent  bool      // the quota is used up
+}
+
+// take returns how many of n bytes may be transferred, at most n; 0 once the quota is
+// used up.
+func (q *quotaMeter) take(n int64) (int64, error) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if !time.Now().Before(q.live) {
+        // the window ended: its counter, and the credit in it, are gone
+        q.credit = 0
+    }
+    if q.credit < n && !q.spent {
+        size := n - q.credit
+        if size < quotaSlice {
+            size = quotaSlice
+        }
+        total, err := q.limiter.AddUsage(bandwidthQuotaScope, q.ip, q.apiKey, size, q.window)
+        if err != nil {
+            return 0, err
+        }
+        if !time.Now().Before(q.live) {
+            before := time.Now()
+            if _, ttl, err := q.limiter.Usage(bandwidthQuotaScope, q.ip, q.apiKey); err == nil {
+                q.live = before.Add(ttl)
+            }
+        }
+        got := granted(total, size, q.quota)
+        if got < size {
+            q.spent = true
+            q.giveBack(size - got)
+        }
+        q.credit += got
+    }
+    if n > q.credit {
+        n = q.credit
+    }
+    q.credit -= n
+    return n, nil
+}
+
+// refund returns bytes taken but not transferred.
+func (q *quotaMeter) refund(n int64) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if time.Now().Before(q.live) {
+        q.credit += n
+    }
+}
+
+// close hands the unused credit back to the quota.
+func (q *quotaMeter) close() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.giveBack(q.credit)
+    q.credit = 0
+}
+
+// giveBack takes n reserved bytes off the counter, only while the window they were
+// reserved in runs: afterwards they would come off the next one.
+func (q *quotaMeter) giveBack(n int64) {
+    if n > 0 && time.Now().Before(q.live) {
+        _, _ = q.limiter.AddUsage(bandwidthQuotaScope, q.ip, q.apiKey, -n, q.window)
+    }
+}
+
+// granted is how much of size, just added to a counter now at total, fits under max.
+// The part that does not fit is left on the counter, which is over max anyway.
+func granted(total, size, max int64) int64 {
+    if total <= max {
+        return size
+    }
+    if prior := total - size; prior < max {
+        return max - prior
+    }
+    return 0
+}
+
+// throttledWriter writes in chunks, each of which must fit in the identifier's
+// shared per-second byte budget (and in the quota, when there is one); when the budget
+// is used up, the write waits for the next second.
+type throttledWriter struct {
+    http.ResponseWriter
+    limiter *limiter.Limiter
+    ip      string
+    apiKey  string
+    rate    int64
+    quota   *quotaMeter
+    r       *http.Request
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+    total := 0
+    for len(p) > 0 {
+        size := int64(len(p))
+        if t.rate > 0 {
+            if size > t.rate {
+                size = t.rate
+            }
+            var err error
+            if size, err = t.wait(size); err != nil {
+                return total, err
+            }
+        }
+        if t.quota != nil {
+            got, err := t.quota.take(size)
+            if err != nil {
+                return total, err
+            }
+            if got == 0 {
+                return total, errBandwidthQuota
+            }
+            size = got
+        }
+        n, err := t.ResponseWriter.Write(p[:size])
+        total += n
+        if t.quota != nil && int64(n) < size {
+            t.quota.refund(size - int64(n))
+        }
+        if err != nil {
+            return total, err
+        }
+        p = p[size:]
+    }
+    return total, nil
+}
+
+// wait reserves up to size bytes of the current second in one round trip, sleeping
+// until the window resets while the budget is exhausted, and returns how many it got.
+// Nothing is handed back: bytes charged past the rate only land on a second whose
+// budget is used up anyway.
+func (t *throttledWriter) wait(size int64) (int64, error) {
+    for {
+        used, err := t.limiter.AddUsage(bandwidthRateScope, t.ip, t.apiKey, size, time.Second)
+        if err != nil {
+            return 0, err
+        }
+        if got := granted(used, size, t.rate); got > 0 {
+            return got, nil
+        }
+        _, ttl, err := t.limiter.Usage(bandwidthRateScope, t.ip, t.apiKey)
+        if err != nil {
+            return 0, err
+        }
+        if ttl < 10*time.Millisecond {
+            ttl = 10 * time.Millisecond
+        }
+        timer := time.NewTimer(ttl)
+        select {
+        case <-t.r.Context().Done():
+            timer.Stop()
+            return 0, t.r.Context().Err()
+        case <-timer.C:
+        }
+    }
+}
+
+func (t *throttledWriter) Flush() {
+    if f, ok := t.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+    return t.ResponseWriter
+}
+
+// quotaReader charges request body bytes to the quota as the handler reads them.
+type quotaReader struct {
+    io.ReadCloser
+    quota *quotaMeter
+}
+
+func (c *quotaReader) Read(p []byte) (int, error) {
+    if len(p) == 0 {
+        return c.ReadCloser.Read(p)
+    }
+    got, err := c.quota.take(int64(len(p)))
+    if err != nil {
+        return 0, err
+    }
+    if got == 0 {
+        return 0, errBandwidthQuota
+    }
+    n, err := c.ReadCloser.Read(p[:got])
+    c.quota.refund(got - int64(n))
+    return n, err
+}
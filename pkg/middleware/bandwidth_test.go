@@ -0,0 +1,131 @@
+package middleware
+
+import (
+    "bytes"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func TestBandwidthHandler_ThrottlesWrites(t *testing.T) {
+    os.Setenv("MODE", "ip")
+
+    mm := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory()))
+    payload := bytes.Repeat([]byte("x"), 2000)
+    handler := mm.BandwidthHandler(BandwidthLimit{BytesPerSecond: 1000}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, _ = w.Write(payload)
+    }))
+
+    start := time.Now()
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/download", nil))
+    if rr.Body.Len() != len(payload) {
+        t.Fatalf("expected full body, got %d bytes", rr.Body.Len())
+    }
+    if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+        t.Fatalf("expected 2000 bytes at 1000 B/s to take about 1s, took %v", elapsed)
+    }
+}
+
+func TestBandwidthHandler_RejectsOverQuota(t *testing.T) {
+    os.Setenv("MODE", "ip")
+
+    mm := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory()))
+    handler := mm.BandwidthHandler(BandwidthLimit{Quota: 1500, Window: time.Minute, CountRequestBody: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        buf := new(bytes.Buffer)
+        _, _ = buf.ReadFrom(r.Body)
+        _, _ = w.Write(bytes.Repeat([]byte("x"), 500))
+    }))
+
+    send := func() int {
+        req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("y", 300)))
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, req)
+        return rr.Code
+    }
+
+    // each request transfers 300 (request) + 500 (response) bytes
+    for i := 1; i <= 2; i++ {
+        if code := send(); code != http.StatusOK {
+            t.Fatalf("expected 200 on request %d, got %d", i, code)
+        }
+    }
+    if code := send(); code != http.StatusTooManyRequests {
+        t.Fatalf("expected 429 once the quota is used, got %d", code)
+    }
+}
+
+func TestBandwidthHandler_StopsResponseAtQuota(t *testing.T) {
+    os.Setenv("MODE", "ip")
+
+    l := limiter.NewLimiter(storagetest.NewMemory())
+    mm := NewLimiterMiddleware(l)
+    var writeErr error
+    handler := mm.BandwidthHandler(BandwidthLimit{Quota: 1000, Window: time.Minute}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        for i := 0; i < 30 && writeErr == nil; i++ {
+            _, writeErr = w.Write(bytes.Repeat([]byte("x"), 100))
+        }
+    }))
+
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/download", nil))
+    if rr.Body.Len() != 1000 || writeErr == nil {
+        t.Fatalf("expected the response cut at 1000 bytes with a write error, got %d bytes, %v", rr.Body.Len(), writeErr)
+    }
+    if used, _, _ := l.Usage(bandwidthQuotaScope, "192.0.2.1", ""); used != 1000 {
+        t.Fatalf("expected 1000 bytes charged, got %d", used)
+    }
+}
+
+func TestBandwidthHandler_ReturnsUnusedQuota(t *testing.T) {
+    os.Setenv("MODE", "ip")
+
+    l := limiter.NewLimiter(storagetest.NewMemory())
+    mm := NewLimiterMiddleware(l)
+    handler := mm.BandwidthHandler(BandwidthLimit{Quota: 1 << 30, Window: time.Minute}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, _ = w.Write(bytes.Repeat([]byte("x"), 10))
+    }))
+
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/download", nil))
+    if used, _, _ := l.Usage(bandwidthQuotaScope, "192.0.2.1", ""); used != 10 {
+        t.Fatalf("expected only the written bytes left on the quota, got %d", used)
+    }
+}
+
+func TestBandwidthHandler_KeepsUnusedQuotaOfEndedWindow(t *testing.T) {
+    os.Setenv("MODE", "ip")
+
+    l := limiter.NewLimiter(storagetest.NewMemory())
+    mm := NewLimiterMiddleware(l)
+    handler := mm.BandwidthHandler(BandwidthLimit{Quota: 1 << 30, Window: 50 * time.Millisecond}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, _ = w.Write(bytes.Repeat([]byte("x"), 10))
+        time.Sleep(100 * time.Millisecond)
+    }))
+
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/download", nil))
+    // handing the credit back now would put the next window below zero
+    if used, _ := l.AddUsage(bandwidthQuotaScope, "192.0.2.1", "", 1, time.Minute); used != 1 {
+        t.Fatalf("expected the next window to start from zero, got %d", used)
+    }
+}
+
+func TestBandwidthHandler_ThrottleReservesWholeWrites(t *testing.T) {
+    os.Setenv("MODE", "ip")
+
+    store := storagetest.NewMemory()
+    mm := NewLimiterMiddleware(limiter.NewLimiter(store))
+    handler := mm.BandwidthHandler(BandwidthLimit{BytesPerSecond: 1 << 20}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, _ = w.Write(bytes.Repeat([]byte("x"), 512<<10))
+    }))
+
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/download", nil))
+    if calls := store.Calls(); calls != 1 {
+        t.Fatalf("expected one round trip for a write within the budget, got %d", calls)
+    }
+}
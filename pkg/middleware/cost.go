@@ -0,0 +1,76 @@
+package middleware
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// CostFunc computes the weight of a request. Values below 1 count as 1.
+type CostFunc func(r *http.Request) int64
+
+// RouteCosts assigns a cost per path. A pattern ending in "/" matches every path
+// under it (like http.ServeMux) and the longest matching pattern wins; unmatched
+// paths cost 1.
+func RouteCosts(costs map[string]int64) CostFunc {
+    return func(r *http.Request) int64 {
+        best := ""
+        cost := int64(1)
+        for pattern, c := range costs {
+            match := r.URL.Path == pattern || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(r.URL.Path, pattern))
+            if match && len(pattern) > len(best) {
+                best = pattern
+                cost = c
+            }
+        }
+        return cost
+    }
+}
+
+// HeaderCost reads the cost from a request header (e.g. a batch size), capped at
+// max when max > 0. Missing or invalid values cost 1.
+func HeaderCost(name string, max int64) CostFunc {
+    return func(r *http.Request) int64 {
+        v, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get(name)), 10, 64)
+        if err != nil || v < 1 {
+            return 1
+        }
+        if max > 0 && v > max {
+            return max
+        }
+        return v
+    }
+}
+
+// MultiplyCosts combines cost functions by multiplying their results, e.g. a route
+// weight times the batch size of the request.
+func MultiplyCosts(fns ...CostFunc) CostFunc {
+    return func(r *http.Request) int64 {
+        cost := int64(1)
+        for _, fn := range fns {
+            if c := fn(r); c > 1 {
+                cost *= c
+            }
+        }
+        return cost
+    }
+}
+
+// ParseRouteCosts parses "path:cost,path2:cost2" (the ROUTE_COSTS format).
+// Invalid entries are skipped.
+func ParseRouteCosts(raw string) map[string]int64 {
+    out := map[string]int64{}
+    for _, p := range strings.Split(raw, ",") {
+        p = strings.TrimSpace(p)
+        idx := strings.LastIndex(p, ":")
+        if idx <= 0 {
+            continue
+        }
+        c, err := strconv.ParseInt(p[idx+1:], 10, 64)
+        if err != nil || c < 1 {
+            continue
+        }
+        out[p[:idx]] = c
+    }
+    return out
+}
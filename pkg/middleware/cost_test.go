@@ -0,0 +1,57 @@
+package middleware
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "testing"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func TestRouteCosts_LongestMatchWins(t *testing.T) {
+    cost := RouteCosts(ParseRouteCosts("/reports/:10,/reports/daily:20,/search:3,bad,/x:0"))
+    cases := map[string]int64{
+        "/reports/monthly": 10,
+        "/reports/daily":   20,
+        "/search":          3,
+        "/search/more":     1,
+        "/x":               1,
+        "/ping":            1,
+    }
+    for path, want := range cases {
+        if got := cost(httptest.NewRequest(http.MethodGet, path, nil)); got != want {
+            t.Fatalf("cost(%s) = %d, want %d", path, got, want)
+        }
+    }
+}
+
+func TestMiddleware_WeightedCost(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "10")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    mm := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory()))
+    mm.Cost = MultiplyCosts(RouteCosts(map[string]int64{"/batch": 2}), HeaderCost("X-Batch-Size", 50))
+    handler := mm.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+
+    // 2 (route) * 4 (batch) = 8 units
+    req := httptest.NewRequest(http.MethodPost, "/batch", nil)
+    req.Header.Set("X-Batch-Size", "4")
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Remaining") != "2" {
+        t.Fatalf("expected 200 with 2 remaining, got %d %v", rr.Code, rr.Header())
+    }
+
+    // another 8 units exceed the budget
+    rr2 := httptest.NewRecorder()
+    handler.ServeHTTP(rr2, req)
+    if rr2.Code != http.StatusTooManyRequests {
+        t.Fatalf("expected 429, got %d", rr2.Code)
+    }
+}
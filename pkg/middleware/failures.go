@@ -0,0 +1,66 @@
+package middleware
+
+import (
+    "encoding/json"
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// FailureLimit counts only responses with the given statuses, e.g. 401/403 on a login
+// route, and blocks the client once more than Limit of them happen within Window.
+type FailureLimit struct {
+    Statuses []int
+    Limit    int
+    Window   time.Duration
+    Block    time.Duration
+    // Scope separates counters of different routes (defaults to "failures").
+    Scope string
+    // TrustForwardedFor keys the counters on the first X-Forwarded-For address instead
+    // of the connection's. Only enable it behind a proxy that overwrites the header:
+    // otherwise a client escapes the block by sending a new address on every attempt.
+    TrustForwardedFor bool
+}
+
+// FailureHandler rejects blocked clients with 429 and otherwise runs next, counting its
+// response towards the client's failures when the status matches.
+func (m *LimiterMiddleware) FailureHandler(fl FailureLimit, next http.Handler) http.Handler {
+    scope := fl.Scope
+    if scope == "" {
+        scope = "failures"
+    }
+    statuses := map[int]bool{}
+    for _, st := range fl.Statuses {
+        statuses[st] = true
+    }
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        apiKey := r.Header.Get("API_KEY")
+        ip := remoteIP(r)
+        if fl.TrustForwardedFor {
+            ip = clientIP(r)
+        }
+
+        lim := m.limiterFor(r)
+        blocked, rem, err := lim.FailuresBlocked(scope, ip, apiKey)
+        if err != nil {
+            http.Error(w, "internal error", http.StatusInternalServerError)
+            return
+        }
+        if blocked {
+            w.Header().Set("Content-Type", "application/json")
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rem.Seconds()))))
+            w.WriteHeader(http.StatusTooManyRequests)
+            body := map[string]string{"message": "too many failed attempts"}
+            _ = json.NewEncoder(w).Encode(body)
+            return
+        }
+
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        next.ServeHTTP(rec, r)
+        if statuses[rec.status] {
+            _, _ = lim.RecordFailure(scope, ip, apiKey, fl.Limit, fl.Window, fl.Block)
+        }
+    })
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func TestFailureHandler_BlocksAfterFailedAttempts(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "100")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    mm := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory()))
+    login := mm.FailureHandler(FailureLimit{
+        Statuses: []int{http.StatusUnauthorized, http.StatusForbidden},
+        Limit:    2,
+        Window:   time.Minute,
+        Block:    time.Minute,
+    }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "secret" {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+    }))
+
+    attempt := func(auth string) int {
+        req := httptest.NewRequest(http.MethodPost, "/login", nil)
+        req.Header.Set("X-Forwarded-For", "1.1.1.1")
+        req.Header.Set("Authorization", auth)
+        rr := httptest.NewRecorder()
+        login.ServeHTTP(rr, req)
+        return rr.Code
+    }
+
+    // successful logins are not counted
+    for i := 0; i < 5; i++ {
+        if code := attempt("secret"); code != http.StatusOK {
+            t.Fatalf("expected 200 for valid login, got %d", code)
+        }
+    }
+
+    // three failures: the third exceeds the threshold of 2
+    for i := 0; i < 3; i++ {
+        if code := attempt("wrong"); code != http.StatusUnauthorized {
+            t.Fatalf("expected 401 for failed login %d, got %d", i+1, code)
+        }
+    }
+
+    // now even valid credentials are rejected until the block expires
+    if code := attempt("secret"); code != http.StatusTooManyRequests {
+        t.Fatalf("expected 429 after too many failures, got %d", code)
+    }
+}
+
+func TestFailureHandler_IgnoresForwardedForUnlessTrusted(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "100")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    unauthorized := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusUnauthorized)
+    })
+    // every attempt comes from the same connection with a new X-Forwarded-For
+    attempt := func(h http.Handler, i int) int {
+        req := httptest.NewRequest(http.MethodPost, "/login", nil)
+        req.RemoteAddr = "203.0.113.9:4711"
+        req.Header.Set("X-Forwarded-For", "10.0.0."+strconv.Itoa(i))
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, req)
+        return rr.Code
+    }
+
+    fl := FailureLimit{Statuses: []int{http.StatusUnauthorized}, Limit: 2, Window: time.Minute, Block: time.Minute}
+    login := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory())).FailureHandler(fl, unauthorized)
+    for i := 0; i < 3; i++ {
+        attempt(login, i)
+    }
+    if code := attempt(login, 3); code != http.StatusTooManyRequests {
+        t.Fatalf("expected rotating X-Forwarded-For not to escape the block, got %d", code)
+    }
+
+    // behind a trusted proxy every forwarded address has its own counter
+    fl.TrustForwardedFor = true
+    login = NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory())).FailureHandler(fl, unauthorized)
+    for i := 0; i < 4; i++ {
+        if code := attempt(login, i); code != http.StatusUnauthorized {
+            t.Fatalf("expected forwarded addresses counted separately, got %d", code)
+        }
+    }
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+    "context"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/durationpb"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+)
+
+// GRPCLimiter provides gRPC server interceptors backed by the limiter.
+type GRPCLimiter struct {
+    limiter *limiter.Limiter
+
+    // PerMethod keeps a separate budget per full method name (/pkg.Service/Method).
+    PerMethod bool
+}
+
+func NewGRPCLimiter(l *limiter.Limiter) *GRPCLimiter {
+    return &GRPCLimiter{limiter: l}
+}
+
+// UnaryServerInterceptor rejects unary calls over the limit with codes.ResourceExhausted.
+// The latency and server errors of allowed calls are fed to the adaptive limits.
+func (g *GRPCLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+    return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+        res, err := g.check(ctx, info.FullMethod)
+        if err != nil {
+            return nil, err
+        }
+        _ = grpc.SetHeader(ctx, rateLimitMetadata(res))
+        if !res.Allowed {
+            return nil, exhausted(res)
+        }
+        start := time.Now()
+        resp, err := handler(ctx, req)
+        g.limiter.Observe(time.Since(start), serverFailure(err))
+        return resp, err
+    }
+}
+
+// StreamServerInterceptor rejects new streams over the limit with codes.ResourceExhausted.
+// Streams are not reported to the adaptive limits: their duration says nothing about
+// the backend's health.
+func (g *GRPCLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+    return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+        res, err := g.check(ss.Context(), info.FullMethod)
+        if err != nil {
+            return err
+        }
+        _ = ss.SetHeader(rateLimitMetadata(res))
+        if !res.Allowed {
+            return exhausted(res)
+        }
+        return handler(srv, ss)
+    }
+}
+
+func (g *GRPCLimiter) check(ctx context.Context, fullMethod string) (limiter.AllowResult, error) {
+    ip, apiKey := grpcIdentity(ctx)
+    scope := ""
+    if g.PerMethod {
+        scope = fullMethod
+    }
+    res, err := g.limiter.AllowScoped(scope, ip, apiKey)
+    if err != nil {
+        return limiter.AllowResult{}, status.Error(codes.Internal, "internal error")
+    }
+    return res, nil
+}
+
+// grpcIdentity extracts the client IP (x-forwarded-for metadata or peer address)
+// and API key (api_key metadata) from the call context.
+func grpcIdentity(ctx context.Context) (string, string) {
+    var ip, apiKey string
+    if md, ok := metadata.FromIncomingContext(ctx); ok {
+        if v := md.Get("api_key"); len(v) > 0 {
+            apiKey = v[0]
+        }
+        if v := md.Get("x-forwarded-for"); len(v) > 0 {
+            ip = strings.TrimSpace(strings.Split(v[0], ",")[0])
+        }
+    }
+    if ip == "" {
+        if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+            ip = p.Addr.String()
+            if host, _, err := net.SplitHostPort(ip); err == nil {
+                ip = host
+            }
+        }
+    }
+    return ip, apiKey
+}
+
+// serverFailure reports whether err is the gRPC counterpart of a 5xx response.
+func serverFailure(err error) bool {
+    switch status.Code(err) {
+    case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss, codes.DeadlineExceeded:
+        return true
+    }
+    return false
+}
+
+func rateLimitMetadata(res limiter.AllowResult) metadata.MD {
+    md := metadata.MD{}
+    if res.Limit > 0 {
+        md.Set("x-ratelimit-limit", strconv.Itoa(res.Limit))
+        md.Set("x-ratelimit-remaining", strconv.FormatInt(res.Remaining(), 10))
+    }
+    return md
+}
+
+func exhausted(res limiter.AllowResult) error {
+    st := status.New(codes.ResourceExhausted, "you have reached the maximum number of requests or actions allowed within a certain time frame")
+    if res.BlockRemain > 0 {
+        if ds, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(res.BlockRemain)}); err == nil {
+            st = ds
+        }
+    }
+    return st.Err()
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+    "context"
+    "net"
+    "os"
+    "testing"
+
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func peerContext(ip string) context.Context {
+    return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}})
+}
+
+func TestUnaryInterceptor_ResourceExhaustedWithRetryInfo(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    g := NewGRPCLimiter(limiter.NewLimiter(storagetest.NewMemory()))
+    interceptor := g.UnaryServerInterceptor()
+    info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Call"}
+    handler := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+
+    ctx := peerContext("10.0.0.1")
+    if _, err := interceptor(ctx, nil, info, handler); err != nil {
+        t.Fatalf("expected first call allowed, got %v", err)
+    }
+    _, err := interceptor(ctx, nil, info, handler)
+    st, _ := status.FromError(err)
+    if st.Code() != codes.ResourceExhausted {
+        t.Fatalf("expected ResourceExhausted, got %v", err)
+    }
+    var retry *errdetails.RetryInfo
+    for _, d := range st.Details() {
+        if ri, ok := d.(*errdetails.RetryInfo); ok {
+            retry = ri
+        }
+    }
+    if retry == nil || retry.RetryDelay.AsDuration() <= 0 {
+        t.Fatalf("expected RetryInfo detail, got %v", st.Details())
+    }
+
+    // another peer is unaffected
+    if _, err := interceptor(peerContext("10.0.0.2"), nil, info, handler); err != nil {
+        t.Fatalf("expected other peer allowed, got %v", err)
+    }
+}
+
+func TestUnaryInterceptor_PerMethodAndToken(t *testing.T) {
+    os.Setenv("MODE", "both")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TOKEN_LIMITS", "tok1:2:10:5")
+
+    g := NewGRPCLimiter(limiter.NewLimiter(storagetest.NewMemory()))
+    g.PerMethod = true
+    interceptor := g.UnaryServerInterceptor()
+    handler := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+    a := &grpc.UnaryServerInfo{FullMethod: "/test.Service/A"}
+    b := &grpc.UnaryServerInfo{FullMethod: "/test.Service/B"}
+
+    // IP budget of 1 is tracked per method
+    ctx := peerContext("10.0.0.3")
+    if _, err := interceptor(ctx, nil, a, handler); err != nil {
+        t.Fatalf("expected A allowed, got %v", err)
+    }
+    if _, err := interceptor(ctx, nil, b, handler); err != nil {
+        t.Fatalf("expected B allowed with its own budget, got %v", err)
+    }
+
+    // token limit (2) read from metadata overrides the IP limit
+    tctx := metadata.NewIncomingContext(peerContext("10.0.0.4"), metadata.Pairs("api_key", "tok1"))
+    for i := 1; i <= 2; i++ {
+        if _, err := interceptor(tctx, nil, a, handler); err != nil {
+            t.Fatalf("expected token call %d allowed, got %v", i, err)
+        }
+    }
+    if _, err := interceptor(tctx, nil, a, handler); status.Code(err) != codes.ResourceExhausted {
+        t.Fatalf("expected ResourceExhausted for token, got %v", err)
+    }
+}
+
+// fakeServerStream is the part of grpc.ServerStream the stream interceptor uses.
+type fakeServerStream struct {
+    grpc.ServerStream
+    ctx    context.Context
+    header metadata.MD
+}
+
+func (s *fakeServerStream) Context() context.Context { return s.ctx }
+
+func (s *fakeServerStream) SetHeader(md metadata.MD) error {
+    s.header = metadata.Join(s.header, md)
+    return nil
+}
+
+func TestStreamInterceptor_AllowsThenRejectsNewStreams(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    g := NewGRPCLimiter(limiter.NewLimiter(storagetest.NewMemory()))
+    interceptor := g.StreamServerInterceptor()
+    info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Watch", IsServerStream: true}
+    calls := 0
+    handler := func(srv any, ss grpc.ServerStream) error {
+        calls++
+        return nil
+    }
+
+    ss := &fakeServerStream{ctx: peerContext("10.0.0.5")}
+    if err := interceptor(nil, ss, info, handler); err != nil {
+        t.Fatalf("expected first stream allowed, got %v", err)
+    }
+    if got := ss.header.Get("x-ratelimit-remaining"); len(got) != 1 || got[0] != "0" {
+        t.Fatalf("expected x-ratelimit-remaining 0 in the header, got %v", ss.header)
+    }
+
+    err := interceptor(nil, &fakeServerStream{ctx: peerContext("10.0.0.5")}, info, handler)
+    st, _ := status.FromError(err)
+    if st.Code() != codes.ResourceExhausted {
+        t.Fatalf("expected ResourceExhausted, got %v", err)
+    }
+    var retry *errdetails.RetryInfo
+    for _, d := range st.Details() {
+        if ri, ok := d.(*errdetails.RetryInfo); ok {
+            retry = ri
+        }
+    }
+    if retry == nil || retry.RetryDelay.AsDuration() <= 0 {
+        t.Fatalf("expected RetryInfo detail, got %v", st.Details())
+    }
+    if calls != 1 {
+        t.Fatalf("expected the handler to run only for the allowed stream, ran %d times", calls)
+    }
+
+    // another peer is unaffected
+    if err := interceptor(nil, &fakeServerStream{ctx: peerContext("10.0.0.6")}, info, handler); err != nil {
+        t.Fatalf("expected other peer allowed, got %v", err)
+    }
+}
+
+func TestUnaryInterceptor_FeedsAdaptiveLimits(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "100")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := limiter.NewLimiter(storagetest.NewMemory())
+    a := limiter.NewAdaptiveLimit()
+    a.SampleSize = 2
+    l.SetAdaptive(a)
+    interceptor := NewGRPCLimiter(l).UnaryServerInterceptor()
+    info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Call"}
+    failing := func(ctx context.Context, req any) (any, error) {
+        return nil, status.Error(codes.Unavailable, "backend down")
+    }
+
+    for i := 0; i < 2; i++ {
+        interceptor(peerContext("10.0.0.7"), nil, info, failing)
+    }
+    if a.Scale() >= 1 {
+        t.Fatalf("expected Unavailable calls to lower the scale, got %v", a.Scale())
+    }
+}
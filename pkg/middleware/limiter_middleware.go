@@ -2,14 +2,26 @@ package middleware
 
 import (
     "encoding/json"
+    "math"
     "net/http"
+    "strconv"
     "strings"
+    "time"
 
     "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
 )
 
 type LimiterMiddleware struct {
     limiter *limiter.Limiter
+
+    // Cost returns how many units of the budget a request consumes (1 when nil).
+    Cost CostFunc
+
+    // TenantHeader names the request header carrying the tenant id; when it names a
+    // tenant listed in TENANT_LIMITS, the request is limited with that tenant's rules
+    // and counters. Any other value is ignored: the header comes from the client, and
+    // a fresh set of counters per made-up tenant would let it reset its own limit.
+    TenantHeader string
 }
 
 func NewLimiterMiddleware(l *limiter.Limiter) *LimiterMiddleware {
@@ -17,6 +29,12 @@ func NewLimiterMiddleware(l *limiter.Limiter) *LimiterMiddleware {
 }
 
 func (m *LimiterMiddleware) Handler(next http.Handler) http.Handler {
+    return m.handler(next, true)
+}
+
+// handler limits the requests to next. With observe, next's latency and server errors
+// are fed to the adaptive limits, which only means something when next does the work.
+func (m *LimiterMiddleware) handler(next http.Handler, observe bool) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         // get API key
         apiKey := r.Header.Get("API_KEY")
@@ -24,11 +42,35 @@ func (m *LimiterMiddleware) Handler(next http.Handler) http.Handler {
         // get IP (X-Forwarded-For or RemoteAddr)
         ip := clientIP(r)
 
-        res, err := m.limiter.Allow(ip, apiKey)
+        cost := int64(1)
+        if m.Cost != nil {
+            cost = m.Cost(r)
+        }
+
+        lim := m.limiterFor(r)
+
+        // in-flight limit, released once the handler returns. It is checked first so a
+        // request turned away for concurrency does not use up rate-limit budget.
+        release, ok, err := lim.Acquire(ip, apiKey)
+        if err != nil {
+            http.Error(w, "internal error", http.StatusInternalServerError)
+            return
+        }
+        if !ok {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusTooManyRequests)
+            body := map[string]string{"message": "too many concurrent requests"}
+            _ = json.NewEncoder(w).Encode(body)
+            return
+        }
+        defer release()
+
+        res, err := lim.AllowN(ip, apiKey, cost)
         if err != nil {
             http.Error(w, "internal error", http.StatusInternalServerError)
             return
         }
+        setRateLimitHeaders(w, res)
         if !res.Allowed {
             w.Header().Set("Content-Type", "application/json")
             w.WriteHeader(http.StatusTooManyRequests)
@@ -36,10 +78,142 @@ func (m *LimiterMiddleware) Handler(next http.Handler) http.Handler {
             _ = json.NewEncoder(w).Encode(body)
             return
         }
-        next.ServeHTTP(w, r)
+
+        if !observe {
+            next.ServeHTTP(w, r)
+            return
+        }
+        // feed latency and server errors to the adaptive limits
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        start := time.Now()
+        next.ServeHTTP(rec, r)
+        lim.Observe(time.Since(start), rec.status >= http.StatusInternalServerError)
     })
 }
 
+// statusRecorder captures the status code written by the wrapped handler.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    wrote  bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+    if !s.wrote {
+        s.status = code
+        s.wrote = true
+    }
+    s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+    s.wrote = true
+    return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+    if f, ok := s.ResponseWriter.(http.Flusher); ok {
+        s.wrote = true
+        f.Flush()
+    }
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (Flush, deadlines).
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
+
+// limiterFor returns the limiter for the request's tenant (see TenantHeader).
+func (m *LimiterMiddleware) limiterFor(r *http.Request) *limiter.Limiter {
+    if m.TenantHeader == "" {
+        return m.limiter
+    }
+    id := r.Header.Get(m.TenantHeader)
+    if !m.limiter.HasTenant(id) {
+        return m.limiter
+    }
+    return m.limiter.Tenant(id)
+}
+
+// ForwardAuthHandler returns an endpoint for nginx auth_request and Traefik forwardAuth.
+// The original request is rebuilt from the forwarded headers and checked by the limiter;
+// it answers 200 when allowed and 429 otherwise, always with rate-limit headers.
+// The proxied request is served elsewhere, so nothing is reported to the adaptive
+// limits: timing the check itself would only ever scale them up.
+func (m *LimiterMiddleware) ForwardAuthHandler() http.Handler {
+    h := m.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }), false)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        h.ServeHTTP(w, originalRequest(r))
+    })
+}
+
+// StatusHandler reports the caller's remaining budget as JSON without consuming it.
+func (m *LimiterMiddleware) StatusHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        st, err := m.limiterFor(r).Status(clientIP(r), r.Header.Get("API_KEY"))
+        if err != nil {
+            http.Error(w, "internal error", http.StatusInternalServerError)
+            return
+        }
+        body := map[string]any{
+            "limit":                   st.Limit,
+            "count":                   st.Count,
+            "remaining":               st.Remaining,
+            "window_seconds":          st.Window.Seconds(),
+            "reset_in_seconds":        st.ResetIn.Seconds(),
+            "reset_at":                time.Now().Add(st.ResetIn).UTC().Format(time.RFC3339),
+            "blocked":                 st.Blocked,
+            "block_remaining_seconds": st.BlockRemain.Seconds(),
+        }
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(body)
+    })
+}
+
+// originalRequest rebuilds the proxied request from the auth subrequest headers.
+// nginx sends X-Original-Method / X-Original-URI / X-Real-IP (as configured),
+// Traefik sends X-Forwarded-Method / X-Forwarded-Uri / X-Forwarded-For.
+func originalRequest(r *http.Request) *http.Request {
+    or := r.Clone(r.Context())
+    if method := firstHeader(r, "X-Original-Method", "X-Forwarded-Method"); method != "" {
+        or.Method = method
+    }
+    if uri := firstHeader(r, "X-Original-URI", "X-Forwarded-Uri"); uri != "" {
+        if u, err := or.URL.Parse(uri); err == nil {
+            or.URL = u
+            or.RequestURI = uri
+        }
+    }
+    // nginx sets X-Real-IP from $remote_addr, while X-Forwarded-For may be the
+    // client's own header passed along: the former wins whenever it is present
+    if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+        or.Header.Set("X-Forwarded-For", realIP)
+    }
+    return or
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+    for _, n := range names {
+        if v := r.Header.Get(n); v != "" {
+            return v
+        }
+    }
+    return ""
+}
+
+// setRateLimitHeaders exposes the limiter decision to clients (and to edge proxies).
+func setRateLimitHeaders(w http.ResponseWriter, res limiter.AllowResult) {
+    if res.Limit > 0 {
+        w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+        w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(res.Remaining(), 10))
+    }
+    if res.Blocked && res.BlockRemain > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.BlockRemain.Seconds()))))
+    }
+}
+
 func clientIP(r *http.Request) string {
     // check X-Forwarded-For
     xff := r.Header.Get("X-Forwarded-For")
@@ -49,6 +223,11 @@ func clientIP(r *http.Request) string {
         return strings.TrimSpace(parts[0])
     }
     // fallback to remote addr (without port)
+    return remoteIP(r)
+}
+
+// remoteIP is the address of the connection itself, ignoring forwarded headers.
+func remoteIP(r *http.Request) string {
     ra := r.RemoteAddr
     // strip port if present
     if idx := strings.LastIndex(ra, ":"); idx != -1 {
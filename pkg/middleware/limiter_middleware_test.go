@@ -5,73 +5,20 @@ import (
     "net/http"
     "net/http/httptest"
     "os"
-    "sync"
     "testing"
     "time"
 
     "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
 )
 
-// mockStorage igual ao usado nos testes do limiter, duplicado aqui para isolamento do pacote
-type mockStorage struct {
-    mu       sync.Mutex
-    counters map[string]struct{
-        count int64
-        exp   time.Time
-    }
-    blocked map[string]time.Time
-}
-
-func newMockStorage() *mockStorage {
-    return &mockStorage{
-        counters: make(map[string]struct{count int64; exp time.Time}),
-        blocked:  make(map[string]time.Time),
-    }
-}
-
-func (m *mockStorage) Increment(key string, window time.Duration) (int64, error) {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    now := time.Now()
-    c, ok := m.counters[key]
-    if !ok || now.After(c.exp) {
-        m.counters[key] = struct{count int64; exp time.Time}{count: 1, exp: now.Add(window)}
-        return 1, nil
-    }
-    c.count++
-    m.counters[key] = c
-    return c.count, nil
-}
-
-func (m *mockStorage) SetBlocked(key string, duration time.Duration) error {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    m.blocked[key] = time.Now().Add(duration)
-    return nil
-}
-
-func (m *mockStorage) IsBlocked(key string) (bool, time.Duration, error) {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    exp, ok := m.blocked[key]
-    if !ok {
-        return false, 0, nil
-    }
-    now := time.Now()
-    if now.After(exp) {
-        delete(m.blocked, key)
-        return false, 0, nil
-    }
-    return true, exp.Sub(now), nil
-}
-
 func TestMiddleware_AllowsUnderLimit(t *testing.T) {
     os.Setenv("MODE", "ip")
     os.Setenv("DEFAULT_LIMIT", "2")
     os.Setenv("DEFAULT_WINDOW", "10")
     os.Setenv("DEFAULT_BLOCK", "5")
 
-    ms := newMockStorage()
+    ms := storagetest.NewMemory()
     l := limiter.NewLimiter(ms)
     mm := NewLimiterMiddleware(l)
 
@@ -101,7 +48,7 @@ func TestMiddleware_Returns429WhenExceeded(t *testing.T) {
     os.Setenv("DEFAULT_WINDOW", "10")
     os.Setenv("DEFAULT_BLOCK", "5")
 
-    ms := newMockStorage()
+    ms := storagetest.NewMemory()
     l := limiter.NewLimiter(ms)
     mm := NewLimiterMiddleware(l)
 
@@ -139,7 +86,7 @@ func TestMiddleware_UsesTokenOverride(t *testing.T) {
     os.Setenv("DEFAULT_BLOCK", "5")
     os.Setenv("TOKEN_LIMITS", "tok1:2:10:5")
 
-    ms := newMockStorage()
+    ms := storagetest.NewMemory()
     l := limiter.NewLimiter(ms)
     mm := NewLimiterMiddleware(l)
 
@@ -170,3 +117,291 @@ func TestMiddleware_UsesTokenOverride(t *testing.T) {
         t.Fatalf("expected 429 third token request, got %d", rr3.Code)
     }
 }
+
+func TestForwardAuth_UsesForwardedHeaders(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    ms := storagetest.NewMemory()
+    l := limiter.NewLimiter(ms)
+    handler := NewLimiterMiddleware(l).ForwardAuthHandler()
+
+    // nginx style subrequest
+    req := httptest.NewRequest(http.MethodGet, "/ratelimit/auth", nil)
+    req.Header.Set("X-Original-Method", http.MethodPost)
+    req.Header.Set("X-Original-URI", "/orders?id=1")
+    req.Header.Set("X-Real-IP", "5.5.5.5")
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("expected 200 first auth request, got %d", rr.Code)
+    }
+    if rr.Header().Get("X-RateLimit-Limit") != "1" || rr.Header().Get("X-RateLimit-Remaining") != "0" {
+        t.Fatalf("unexpected rate limit headers: %v", rr.Header())
+    }
+
+    // traefik style subrequest for the same client is rejected
+    req2 := httptest.NewRequest(http.MethodGet, "/ratelimit/auth", nil)
+    req2.Header.Set("X-Forwarded-Method", http.MethodGet)
+    req2.Header.Set("X-Forwarded-Uri", "/orders")
+    req2.Header.Set("X-Forwarded-For", "5.5.5.5")
+    rr2 := httptest.NewRecorder()
+    handler.ServeHTTP(rr2, req2)
+    if rr2.Code != http.StatusTooManyRequests {
+        t.Fatalf("expected 429 second auth request, got %d", rr2.Code)
+    }
+    if rr2.Header().Get("Retry-After") == "" {
+        t.Fatalf("expected Retry-After header on 429")
+    }
+
+    // a different client is still allowed
+    req3 := httptest.NewRequest(http.MethodGet, "/ratelimit/auth", nil)
+    req3.Header.Set("X-Forwarded-For", "6.6.6.6")
+    rr3 := httptest.NewRecorder()
+    handler.ServeHTTP(rr3, req3)
+    if rr3.Code != http.StatusOK {
+        t.Fatalf("expected 200 for other client, got %d", rr3.Code)
+    }
+}
+
+func TestForwardAuth_RealIPWinsOverForwardedFor(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    handler := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory())).ForwardAuthHandler()
+
+    // nginx passes the client's own X-Forwarded-For along; a new fake address on
+    // every request must not give it a new budget
+    for i, spoofed := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+        req := httptest.NewRequest(http.MethodGet, "/ratelimit/auth", nil)
+        req.Header.Set("X-Real-IP", "5.5.5.5")
+        req.Header.Set("X-Forwarded-For", spoofed)
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, req)
+        want := http.StatusOK
+        if i > 0 {
+            want = http.StatusTooManyRequests
+        }
+        if rr.Code != want {
+            t.Fatalf("request %d: expected %d, got %d", i+1, want, rr.Code)
+        }
+        if rr.Header().Get("X-RateLimit-Limit") != "1" || rr.Header().Get("X-RateLimit-Remaining") != "0" {
+            t.Fatalf("request %d: unexpected rate limit headers: %v", i+1, rr.Header())
+        }
+    }
+}
+
+func TestForwardAuth_DoesNotFeedAdaptiveLimits(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "100")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    l := limiter.NewLimiter(storagetest.NewMemory())
+    a := limiter.NewAdaptiveLimit()
+    a.SampleSize = 2
+    l.SetAdaptive(a)
+    mm := NewLimiterMiddleware(l)
+
+    // the check answers instantly whatever the backend does; it must not count as healthy
+    auth := mm.ForwardAuthHandler()
+    for i := 0; i < 10; i++ {
+        auth.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ratelimit/auth", nil))
+    }
+    if a.Scale() != 1 {
+        t.Fatalf("expected forward auth to leave the scale at 1, got %v", a.Scale())
+    }
+
+    // the middleware in front of a handler does report
+    handler := mm.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusInternalServerError)
+    }))
+    for i := 0; i < 2; i++ {
+        handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+    }
+    if a.Scale() >= 1 {
+        t.Fatalf("expected failing requests to lower the scale, got %v", a.Scale())
+    }
+}
+
+func TestStatusHandler_ReportsWithoutConsuming(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "2")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    mm := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory()))
+    limited := mm.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+    status := mm.StatusHandler()
+
+    req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+    limited.ServeHTTP(httptest.NewRecorder(), req)
+
+    for i := 0; i < 3; i++ {
+        rr := httptest.NewRecorder()
+        status.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/ratelimit/status", nil))
+        if rr.Code != http.StatusOK {
+            t.Fatalf("expected 200 from status, got %d", rr.Code)
+        }
+        var body map[string]any
+        if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+            t.Fatalf("invalid json body: %v", err)
+        }
+        if body["remaining"] != float64(1) || body["limit"] != float64(2) || body["blocked"] != false {
+            t.Fatalf("unexpected status body: %v", body)
+        }
+    }
+
+    // the status calls did not consume the last slot
+    rr := httptest.NewRecorder()
+    limited.ServeHTTP(rr, req)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("expected 200 after status checks, got %d", rr.Code)
+    }
+}
+
+func TestMiddleware_ConcurrencyLimit(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "100")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("CONCURRENCY_LIMIT", "1")
+    defer os.Unsetenv("CONCURRENCY_LIMIT")
+
+    ms := storagetest.NewMemory()
+    l := limiter.NewLimiter(ms)
+    mm := NewLimiterMiddleware(l)
+
+    entered := make(chan struct{})
+    unblock := make(chan struct{})
+    handler := mm.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/slow" {
+            close(entered)
+            <-unblock
+        }
+        w.WriteHeader(http.StatusOK)
+    }))
+
+    done := make(chan int)
+    go func() {
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/slow", nil))
+        done <- rr.Code
+    }()
+    <-entered
+
+    // second in-flight request from the same client is rejected
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fast", nil))
+    if rr.Code != http.StatusTooManyRequests {
+        t.Fatalf("expected 429 while a request is in flight, got %d", rr.Code)
+    }
+    // the rejected request did not use up rate-limit budget
+    if st, _ := l.Status("192.0.2.1", ""); st.Count != 1 {
+        t.Fatalf("expected only the in-flight request counted, got %d", st.Count)
+    }
+
+    close(unblock)
+    if code := <-done; code != http.StatusOK {
+        t.Fatalf("expected slow request to succeed, got %d", code)
+    }
+
+    // slot was released after the handler returned
+    rr2 := httptest.NewRecorder()
+    handler.ServeHTTP(rr2, httptest.NewRequest(http.MethodGet, "/fast", nil))
+    if rr2.Code != http.StatusOK {
+        t.Fatalf("expected 200 after release, got %d", rr2.Code)
+    }
+}
+
+func TestMiddleware_ConcurrencyLeaseNotPositive(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "100")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("CONCURRENCY_LIMIT", "1")
+    os.Setenv("CONCURRENCY_LEASE", "0")
+    defer os.Unsetenv("CONCURRENCY_LIMIT")
+    defer os.Unsetenv("CONCURRENCY_LEASE")
+
+    // the lease renewal used to panic with a zero lease, taking the process down
+    handler := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory())).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(600 * time.Millisecond)
+        w.WriteHeader(http.StatusOK)
+    }))
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+    if rr.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d", rr.Code)
+    }
+}
+
+func TestMiddleware_TenantHeader(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TENANT_LIMITS", "a:1:10:5,b:1:10:5")
+    defer os.Unsetenv("TENANT_LIMITS")
+
+    mm := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory()))
+    mm.TenantHeader = "X-Tenant-ID"
+    handler := mm.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+
+    send := func(tenant string) int {
+        req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+        req.Header.Set("X-Tenant-ID", tenant)
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, req)
+        return rr.Code
+    }
+
+    if send("a") != http.StatusOK || send("b") != http.StatusOK {
+        t.Fatalf("expected first request of each tenant to pass")
+    }
+    if send("a") != http.StatusTooManyRequests {
+        t.Fatalf("expected tenant a to be limited")
+    }
+}
+
+func TestMiddleware_UnknownTenantsShareDefaultCounters(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "2")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TENANT_LIMITS", "acme:5:10:5")
+    defer os.Unsetenv("TENANT_LIMITS")
+
+    mm := NewLimiterMiddleware(limiter.NewLimiter(storagetest.NewMemory()))
+    mm.TenantHeader = "X-Tenant-ID"
+    handler := mm.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+
+    send := func(tenant string) int {
+        req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+        req.Header.Set("X-Tenant-ID", tenant)
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, req)
+        return rr.Code
+    }
+
+    // a client rotating made-up tenants stays on the default counter
+    if send("x1") != http.StatusOK || send("x2") != http.StatusOK {
+        t.Fatalf("expected the first two requests to pass")
+    }
+    if code := send("x3"); code != http.StatusTooManyRequests {
+        t.Fatalf("expected rotating the tenant header not to reset the limit, got %d", code)
+    }
+    // a listed tenant still has its own counters
+    if code := send("acme"); code != http.StatusOK {
+        t.Fatalf("expected tenant acme to be counted apart, got %d", code)
+    }
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+)
+
+// Transport is an http.RoundTripper that throttles outgoing requests per destination
+// host. Hosts use the default limits unless given their own in OUTBOUND_LIMITS (e.g.
+// api.example.com:100:1:60); their counters are kept apart from inbound clients'.
+type Transport struct {
+    limiter *limiter.Limiter
+    next    http.RoundTripper
+
+    // Wait makes requests wait (bounded by the request context) until the host is
+    // available again instead of failing fast with a *RateLimitedError.
+    Wait bool
+    // MaxRetries is how many times a request rejected upstream with 429 is retried
+    // when Wait is set and the request body can be replayed.
+    MaxRetries int
+}
+
+// NewTransport wraps next (http.DefaultTransport when nil).
+func NewTransport(l *limiter.Limiter, next http.RoundTripper) *Transport {
+    if next == nil {
+        next = http.DefaultTransport
+    }
+    return &Transport{limiter: l, next: next, MaxRetries: 3}
+}
+
+// RateLimitedError is returned when a request is rejected locally.
+type RateLimitedError struct {
+    Host       string
+    RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+    return fmt.Sprintf("rate limited: requests to %s can resume in %s", e.Host, e.RetryAfter)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    host := req.URL.Hostname()
+    for attempt := 0; ; attempt++ {
+        if err := t.acquire(req, host); err != nil {
+            closeBody(req)
+            return nil, err
+        }
+
+        resp, err := t.next.RoundTrip(req)
+        if err != nil || !upstreamLimited(resp) {
+            return resp, err
+        }
+
+        // upstream told us to slow down: block the host so every caller backs off
+        backoff := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+        if err := t.limiter.BlockHost(host, backoff); err != nil {
+            return resp, nil
+        }
+        if !t.Wait || attempt >= t.MaxRetries || !replayable(req) {
+            return resp, nil
+        }
+        _ = resp.Body.Close()
+
+        // a RoundTripper must not modify the caller's request: retry on a copy
+        retry := req.Clone(req.Context())
+        if req.GetBody != nil {
+            body, err := req.GetBody()
+            if err != nil {
+                return nil, err
+            }
+            retry.Body = body
+        }
+        req = retry
+    }
+}
+
+// acquire consumes a slot for host. With Wait set it sleeps while the host is blocked,
+// or until its window resets when the host is only over its rate.
+func (t *Transport) acquire(req *http.Request, host string) error {
+    for {
+        res, err := t.limiter.AllowHost(host)
+        if err != nil {
+            return err
+        }
+        if res.Allowed {
+            return nil
+        }
+        delay := res.BlockRemain
+        if delay <= 0 {
+            delay = res.ResetIn
+        }
+        if delay <= 0 {
+            delay = res.Window
+        }
+        if !t.Wait {
+            return &RateLimitedError{Host: host, RetryAfter: delay}
+        }
+        timer := time.NewTimer(delay)
+        select {
+        case <-req.Context().Done():
+            timer.Stop()
+            return req.Context().Err()
+        case <-timer.C:
+        }
+    }
+}
+
+func upstreamLimited(resp *http.Response) bool {
+    if resp.StatusCode == http.StatusTooManyRequests {
+        return true
+    }
+    return resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != ""
+}
+
+// retryAfter parses a Retry-After value (delay in seconds or HTTP date). It returns
+// zero when absent or invalid, which means "use the configured block duration".
+func retryAfter(v string, now time.Time) time.Duration {
+    if v == "" {
+        return 0
+    }
+    if secs, err := strconv.Atoi(v); err == nil {
+        if secs < 0 {
+            return 0
+        }
+        return time.Duration(secs) * time.Second
+    }
+    if at, err := http.ParseTime(v); err == nil && at.After(now) {
+        return at.Sub(now)
+    }
+    return 0
+}
+
+// closeBody closes the body of a request that will not be sent, as RoundTrip must.
+func closeBody(req *http.Request) {
+    if req.Body != nil {
+        _ = req.Body.Close()
+    }
+}
+
+func replayable(req *http.Request) bool {
+    return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
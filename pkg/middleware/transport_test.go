@@ -0,0 +1,176 @@
+package middleware
+
+import (
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func TestTransport_FailsFastPerHost(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer upstream.Close()
+
+    client := &http.Client{Transport: NewTransport(limiter.NewLimiter(storagetest.NewMemory()), nil)}
+    resp, err := client.Get(upstream.URL)
+    if err != nil {
+        t.Fatalf("expected first request to pass, got %v", err)
+    }
+    resp.Body.Close()
+
+    _, err = client.Get(upstream.URL)
+    var rlErr *RateLimitedError
+    if !errors.As(err, &rlErr) {
+        t.Fatalf("expected RateLimitedError, got %v", err)
+    }
+    if rlErr.RetryAfter <= 0 {
+        t.Fatalf("expected positive retry after, got %v", rlErr.RetryAfter)
+    }
+}
+
+func TestTransport_WaitsOnlyForTheWindowToReset(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "1")
+    os.Setenv("DEFAULT_BLOCK", "300")
+
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer upstream.Close()
+
+    l := limiter.NewLimiter(storagetest.NewMemory())
+    tr := NewTransport(l, nil)
+    tr.Wait = true
+    client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+    start := time.Now()
+    for i := 1; i <= 2; i++ {
+        resp, err := client.Get(upstream.URL)
+        if err != nil {
+            t.Fatalf("expected request %d to pass, got %v", i, err)
+        }
+        resp.Body.Close()
+    }
+    // the second request waits for the next 1s window, not for DEFAULT_BLOCK
+    if elapsed := time.Since(start); elapsed > 3*time.Second {
+        t.Fatalf("expected to wait about one window, took %v", elapsed)
+    }
+
+    res, err := l.AllowHost("127.0.0.1")
+    if err != nil {
+        t.Fatalf("allow host: %v", err)
+    }
+    if res.Allowed || res.Blocked || res.ResetIn <= 0 || res.ResetIn > time.Second {
+        t.Fatalf("expected a throttled, unblocked host with the window TTL, got %+v", res)
+    }
+}
+
+func TestTransport_BacksOffOnUpstream429(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "100")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "300")
+
+    var calls int32
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if body, _ := io.ReadAll(r.Body); string(body) != "payload" {
+            t.Errorf("expected the body on every attempt, got %q", body)
+        }
+        if atomic.AddInt32(&calls, 1) == 1 {
+            w.Header().Set("Retry-After", "1")
+            w.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer upstream.Close()
+
+    tr := NewTransport(limiter.NewLimiter(storagetest.NewMemory()), nil)
+    tr.Wait = true
+    client := &http.Client{Transport: tr}
+
+    req, _ := http.NewRequest(http.MethodPost, upstream.URL, strings.NewReader("payload"))
+    body := req.Body
+    start := time.Now()
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    resp.Body.Close()
+    if req.Body != body {
+        t.Fatalf("expected the caller's request left untouched by the retry")
+    }
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("expected retried request to succeed, got %d", resp.StatusCode)
+    }
+    if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+        t.Fatalf("expected to back off ~1s before retrying, took %v", elapsed)
+    }
+    if atomic.LoadInt32(&calls) != 2 {
+        t.Fatalf("expected 2 upstream calls, got %d", calls)
+    }
+}
+
+func TestTransport_HostLimitsAreNotAPIKeys(t *testing.T) {
+    os.Setenv("MODE", "token")
+    os.Setenv("DEFAULT_LIMIT", "10")
+    os.Setenv("DEFAULT_WINDOW", "10")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TOKEN_LIMITS", "")
+    os.Setenv("OUTBOUND_LIMITS", "127.0.0.1:2:10:5")
+    defer os.Unsetenv("OUTBOUND_LIMITS")
+
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer upstream.Close()
+
+    l := limiter.NewLimiter(storagetest.NewMemory())
+    client := &http.Client{Transport: NewTransport(l, nil)}
+    // MODE=token only applies to inbound clients; the host has its own limit of 2
+    for i := 1; i <= 2; i++ {
+        resp, err := client.Get(upstream.URL)
+        if err != nil {
+            t.Fatalf("expected request %d to pass, got %v", i, err)
+        }
+        resp.Body.Close()
+    }
+    var rlErr *RateLimitedError
+    if _, err := client.Get(upstream.URL); !errors.As(err, &rlErr) {
+        t.Fatalf("expected the host limit enforced, got %v", err)
+    }
+
+    // a host name is not an API key
+    if res, _ := l.Allow("9.9.9.9", "127.0.0.1"); res.Allowed {
+        t.Fatalf("expected the host name to be rejected as an API key, got %+v", res)
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    if d := retryAfter("7", now); d != 7*time.Second {
+        t.Fatalf("expected 7s, got %v", d)
+    }
+    if d := retryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now); d != 30*time.Second {
+        t.Fatalf("expected 30s, got %v", d)
+    }
+    if d := retryAfter("soon", now); d != 0 {
+        t.Fatalf("expected 0 for invalid value, got %v", d)
+    }
+}
@@ -0,0 +1,191 @@
+// Package rls implements Envoy's global rate limit service
+// (envoy.service.ratelimit.v3.RateLimitService) on top of limiter.Limiter.
+package rls
+
+import (
+    "context"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+
+    corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+    ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+    rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/durationpb"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+)
+
+// Service answers ShouldRateLimit calls. Each descriptor is mapped onto a limiter rule:
+// the entry named IPKey is used as the client address, the entry named TokenKey as the
+// API key (token limits override IP limits as usual), and any other entries are folded,
+// together with the domain, into the scope so every combination of their values gets
+// its own counters, whichever rule applies. A descriptor with none of these (or only an
+// API key without limits of its own) identifies no one; it is answered OK without being
+// counted, instead of sharing one counter among all such callers.
+//
+// Envoy does not tell the service how requests went, so nothing is reported to the
+// adaptive limits from here; they only move with traffic seen by the HTTP middleware
+// or the unary gRPC interceptor.
+type Service struct {
+    rlsv3.UnimplementedRateLimitServiceServer
+
+    limiter *limiter.Limiter
+
+    IPKey    string
+    TokenKey string
+}
+
+// NewService creates a Service using Envoy's "remote_address" descriptor for IPs
+// and "api_key" for tokens.
+func NewService(l *limiter.Limiter) *Service {
+    return &Service{limiter: l, IPKey: "remote_address", TokenKey: "api_key"}
+}
+
+func (s *Service) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+    if len(req.GetDescriptors()) == 0 {
+        return nil, status.Error(codes.InvalidArgument, "no descriptors in request")
+    }
+
+    resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+    var tightest *limiter.AllowResult
+    for _, d := range req.GetDescriptors() {
+        scope, ip, apiKey, ok := s.identity(req.GetDomain(), d)
+        if !ok {
+            resp.Statuses = append(resp.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK})
+            continue
+        }
+        res, err := s.check(scope, ip, apiKey, hits(req, d))
+        if err != nil {
+            return nil, status.Errorf(codes.Unavailable, "limiter: %v", err)
+        }
+
+        st := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+        if !res.Allowed {
+            st.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+            resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+        }
+        if res.Limit > 0 {
+            st.CurrentLimit = currentLimit(res.Limit, res.Window)
+            st.LimitRemaining = uint32(res.Remaining())
+        }
+        if res.Blocked && res.BlockRemain > 0 {
+            st.DurationUntilReset = durationpb.New(res.BlockRemain)
+        }
+        resp.Statuses = append(resp.Statuses, st)
+
+        if tightest == nil || moreRestrictive(res, *tightest) {
+            r := res
+            tightest = &r
+        }
+    }
+    if tightest != nil {
+        resp.ResponseHeadersToAdd = headers(*tightest)
+    }
+    return resp, nil
+}
+
+// check consumes n units, or only peeks at the budget when n is zero (Envoy sends
+// hits_addend 0 to ask whether a request is over the limit without counting it).
+func (s *Service) check(scope, ip, apiKey string, n int64) (limiter.AllowResult, error) {
+    if n > 0 {
+        return s.limiter.AllowScopedN(scope, ip, apiKey, n)
+    }
+    st, err := s.limiter.StatusScoped(scope, ip, apiKey)
+    if err != nil {
+        return limiter.AllowResult{}, err
+    }
+    return limiter.AllowResult{
+        Allowed:     !st.Blocked && int64(st.Limit) > st.Count,
+        Count:       st.Count,
+        Limit:       st.Limit,
+        Window:      st.Window,
+        Blocked:     st.Blocked,
+        BlockRemain: st.BlockRemain,
+    }, nil
+}
+
+// hits is the cost of a descriptor: its own hits_addend, the request's, or 1.
+func hits(req *rlsv3.RateLimitRequest, d *ratelimitv3.RateLimitDescriptor) int64 {
+    if h := d.GetHitsAddend(); h != nil {
+        return int64(h.GetValue())
+    }
+    if req.GetHitsAddend() > 0 {
+        return int64(req.GetHitsAddend())
+    }
+    return 1
+}
+
+// identity maps a descriptor onto the (scope, ip, apiKey) understood by the limiter.
+// ok is false when the descriptor has no address, no other entries and no API key with
+// limits of its own.
+func (s *Service) identity(domain string, d *ratelimitv3.RateLimitDescriptor) (scope, ip, apiKey string, ok bool) {
+    var rest []string
+    for _, e := range d.GetEntries() {
+        switch e.GetKey() {
+        case s.IPKey:
+            ip = e.GetValue()
+        case s.TokenKey:
+            apiKey = e.GetValue()
+        default:
+            rest = append(rest, e.GetKey()+"="+e.GetValue())
+        }
+    }
+    if len(rest) > 0 {
+        scope = strings.Join(append([]string{domain}, rest...), "|")
+    }
+    return scope, ip, apiKey, ip != "" || scope != "" || s.limiter.HasToken(apiKey)
+}
+
+// moreRestrictive reports whether a should be preferred over b when picking the
+// descriptor whose limits are reported back in headers.
+func moreRestrictive(a, b limiter.AllowResult) bool {
+    if a.Allowed != b.Allowed {
+        return !a.Allowed
+    }
+    if b.Limit <= 0 {
+        return a.Limit > 0
+    }
+    return a.Limit > 0 && a.Remaining() < b.Remaining()
+}
+
+// currentLimit expresses limit/window in Envoy units. Windows that do not match a
+// unit exactly are reported per second (rounded down, at least 1).
+func currentLimit(limit int, window time.Duration) *rlsv3.RateLimitResponse_RateLimit {
+    units := []struct {
+        d    time.Duration
+        unit rlsv3.RateLimitResponse_RateLimit_Unit
+    }{
+        {time.Second, rlsv3.RateLimitResponse_RateLimit_SECOND},
+        {time.Minute, rlsv3.RateLimitResponse_RateLimit_MINUTE},
+        {time.Hour, rlsv3.RateLimitResponse_RateLimit_HOUR},
+        {24 * time.Hour, rlsv3.RateLimitResponse_RateLimit_DAY},
+    }
+    for _, u := range units {
+        if window == u.d {
+            return &rlsv3.RateLimitResponse_RateLimit{RequestsPerUnit: uint32(limit), Unit: u.unit}
+        }
+    }
+    perSecond := uint32(1)
+    if secs := window.Seconds(); secs > 0 && float64(limit)/secs >= 1 {
+        perSecond = uint32(float64(limit) / secs)
+    }
+    return &rlsv3.RateLimitResponse_RateLimit{RequestsPerUnit: perSecond, Unit: rlsv3.RateLimitResponse_RateLimit_SECOND}
+}
+
+func headers(res limiter.AllowResult) []*corev3.HeaderValue {
+    var out []*corev3.HeaderValue
+    if res.Limit > 0 {
+        out = append(out,
+            &corev3.HeaderValue{Key: "X-RateLimit-Limit", Value: strconv.Itoa(res.Limit)},
+            &corev3.HeaderValue{Key: "X-RateLimit-Remaining", Value: strconv.FormatInt(res.Remaining(), 10)},
+        )
+    }
+    if res.Blocked && res.BlockRemain > 0 {
+        out = append(out, &corev3.HeaderValue{Key: "Retry-After", Value: strconv.Itoa(int(math.Ceil(res.BlockRemain.Seconds())))})
+    }
+    return out
+}
@@ -0,0 +1,177 @@
+package rls
+
+import (
+    "context"
+    "net"
+    "os"
+    "testing"
+
+    ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+    rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/test/bufconn"
+
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/limiter"
+    "github.com/Douglas-Souza40/fctech-rate-limiter/internal/storage/storagetest"
+)
+
+func newClient(t *testing.T, svc *Service) rlsv3.RateLimitServiceClient {
+    lis := bufconn.Listen(1 << 20)
+    srv := grpc.NewServer()
+    rlsv3.RegisterRateLimitServiceServer(srv, svc)
+    go func() { _ = srv.Serve(lis) }()
+    t.Cleanup(srv.Stop)
+
+    conn, err := grpc.NewClient("passthrough:///bufnet",
+        grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+        grpc.WithTransportCredentials(insecure.NewCredentials()),
+    )
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    t.Cleanup(func() { _ = conn.Close() })
+    return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(kv ...string) *ratelimitv3.RateLimitDescriptor {
+    d := &ratelimitv3.RateLimitDescriptor{}
+    for i := 0; i+1 < len(kv); i += 2 {
+        d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+    }
+    return d
+}
+
+func TestShouldRateLimit_OverLimitByIP(t *testing.T) {
+    os.Setenv("MODE", "ip")
+    os.Setenv("DEFAULT_LIMIT", "2")
+    os.Setenv("DEFAULT_WINDOW", "1")
+    os.Setenv("DEFAULT_BLOCK", "5")
+
+    client := newClient(t, NewService(limiter.NewLimiter(storagetest.NewMemory())))
+    req := &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", "1.2.3.4")}}
+
+    for i := 1; i <= 2; i++ {
+        resp, err := client.ShouldRateLimit(context.Background(), req)
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        if resp.OverallCode != rlsv3.RateLimitResponse_OK {
+            t.Fatalf("expected OK on attempt %d, got %v", i, resp.OverallCode)
+        }
+        st := resp.Statuses[0]
+        if st.CurrentLimit.GetRequestsPerUnit() != 2 || st.CurrentLimit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_SECOND {
+            t.Fatalf("unexpected current limit: %v", st.CurrentLimit)
+        }
+        if st.LimitRemaining != uint32(2-i) {
+            t.Fatalf("expected %d remaining, got %d", 2-i, st.LimitRemaining)
+        }
+    }
+
+    resp, err := client.ShouldRateLimit(context.Background(), req)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT || resp.Statuses[0].Code != rlsv3.RateLimitResponse_OVER_LIMIT {
+        t.Fatalf("expected OVER_LIMIT, got %v", resp)
+    }
+    if resp.Statuses[0].DurationUntilReset.AsDuration() <= 0 {
+        t.Fatalf("expected duration until reset, got %v", resp.Statuses[0].DurationUntilReset)
+    }
+    found := false
+    for _, h := range resp.ResponseHeadersToAdd {
+        if h.Key == "Retry-After" {
+            found = true
+        }
+    }
+    if !found {
+        t.Fatalf("expected Retry-After header, got %v", resp.ResponseHeadersToAdd)
+    }
+}
+
+func TestShouldRateLimit_PerDescriptorStatuses(t *testing.T) {
+    os.Setenv("MODE", "both")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "60")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TOKEN_LIMITS", "tok1:5:60:5")
+
+    client := newClient(t, NewService(limiter.NewLimiter(storagetest.NewMemory())))
+    req := &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+        descriptor("api_key", "tok1"),
+        descriptor("path", "/orders", "remote_address", "1.2.3.4"),
+    }}
+
+    resp, err := client.ShouldRateLimit(context.Background(), req)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if resp.OverallCode != rlsv3.RateLimitResponse_OK || len(resp.Statuses) != 2 {
+        t.Fatalf("expected OK with 2 statuses, got %v", resp)
+    }
+    if resp.Statuses[0].CurrentLimit.GetRequestsPerUnit() != 5 || resp.Statuses[0].CurrentLimit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_MINUTE {
+        t.Fatalf("expected token limit 5/minute, got %v", resp.Statuses[0].CurrentLimit)
+    }
+
+    // the path descriptor has its own IP counter (limit 1) and is now exhausted
+    resp, err = client.ShouldRateLimit(context.Background(), req)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+        t.Fatalf("expected OVER_LIMIT, got %v", resp.OverallCode)
+    }
+    if resp.Statuses[0].Code != rlsv3.RateLimitResponse_OK || resp.Statuses[1].Code != rlsv3.RateLimitResponse_OVER_LIMIT {
+        t.Fatalf("unexpected per-descriptor codes: %v", resp.Statuses)
+    }
+}
+
+func TestShouldRateLimit_DescriptorWithoutClientIsNotCounted(t *testing.T) {
+    os.Setenv("MODE", "both")
+    os.Setenv("DEFAULT_LIMIT", "1")
+    os.Setenv("DEFAULT_WINDOW", "60")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TOKEN_LIMITS", "")
+
+    store := storagetest.NewMemory()
+    client := newClient(t, NewService(limiter.NewLimiter(store)))
+    // an unconfigured API key and no address: counting it would share one "ip:"
+    // counter (and block) among every such caller
+    req := &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("api_key", "unknown")}}
+    for i := 0; i < 3; i++ {
+        resp, err := client.ShouldRateLimit(context.Background(), req)
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        if resp.OverallCode != rlsv3.RateLimitResponse_OK || resp.Statuses[0].CurrentLimit != nil {
+            t.Fatalf("expected OK without a limit, got %v", resp)
+        }
+    }
+    if keys := store.Keys(); len(keys) != 0 {
+        t.Fatalf("expected nothing counted, got %v", keys)
+    }
+}
+
+func TestShouldRateLimit_TokenDescriptorsKeepOwnCounters(t *testing.T) {
+    os.Setenv("MODE", "both")
+    os.Setenv("DEFAULT_LIMIT", "10")
+    os.Setenv("DEFAULT_WINDOW", "60")
+    os.Setenv("DEFAULT_BLOCK", "5")
+    os.Setenv("TOKEN_LIMITS", "tok1:1:60:5")
+
+    client := newClient(t, NewService(limiter.NewLimiter(storagetest.NewMemory())))
+    call := func(path string) rlsv3.RateLimitResponse_Code {
+        req := &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("api_key", "tok1", "path", path)}}
+        resp, err := client.ShouldRateLimit(context.Background(), req)
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        return resp.OverallCode
+    }
+    if call("/a") != rlsv3.RateLimitResponse_OK || call("/a") != rlsv3.RateLimitResponse_OVER_LIMIT {
+        t.Fatalf("expected the token limit of 1 to apply to /a")
+    }
+    if call("/b") != rlsv3.RateLimitResponse_OK {
+        t.Fatalf("expected /b to have its own token counter")
+    }
+}